@@ -5,36 +5,123 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	format "github.com/cloudevents/sdk-go/binding/format/protobuf/v2"
 	cloudevents "github.com/cloudevents/sdk-go/v2"
 	"github.com/google/uuid"
 	"github.com/nite-coder/blackbear/pkg/cast"
+	"github.com/nite-coder/blackbear/pkg/log"
 	"google.golang.org/protobuf/proto"
 )
 
 var (
 	ErrInvalidEventType = errors.New("prelude: eventType can't be empty")
+	// ErrPresenceNotFound is returned when the router doesn't have presence
+	ErrPresenceNotFound = errors.New("prelude: presence not found")
+	// ErrHandlerPanic is returned when the handler panics
+	ErrHandlerPanic = errors.New("prelude: handler panicked")
 )
 
+// WriteOption configures WriteToUser
+type WriteOption func(*writeOptions)
+
+type writeOptions struct {
+	excludeSender bool
+}
+
+// ExcludeSender skips the sender session, e.g. the message is sent to the other devices of user
+func ExcludeSender() WriteOption {
+	return func(o *writeOptions) {
+		o.excludeSender = true
+	}
+}
+
+const abortIndex = math.MaxInt16
+
 type Context struct {
-	hub   Huber
-	Event cloudevents.Event
+	hub      Huber
+	handlers []HandlerFunc
+	index    int
+	pnames   []string
+	pvalues  []string
+	Event    cloudevents.Event
 }
 
 func NewContext(hub Huber, event cloudevents.Event) *Context {
 	return &Context{
 		hub:   hub,
+		index: -1,
 		Event: event,
 	}
 }
 
+// Next executes the pending handlers in the chain.  It should only be used inside middleware.
+func (c *Context) Next() error {
+	c.index++
+	for c.index < len(c.handlers) {
+		err := c.handlers[c.index](c)
+		if err != nil {
+			c.Abort()
+			return err
+		}
+		c.index++
+	}
+	return nil
+}
+
+// Abort prevents pending handlers from being called.  It doesn't stop the current handler.
+func (c *Context) Abort() {
+	c.index = abortIndex
+}
+
+// IsAborted returns true if the current context was aborted.
+func (c *Context) IsAborted() bool {
+	return c.index >= abortIndex
+}
+
 func (c *Context) SenderSessionID() string {
 	sessionID, _ := cast.ToString(c.Get(SessionID))
 	return sessionID
 }
 
+// Param returns the value of the param segment by name, e.g. "roomID" for action "room.:roomID.join".
+// The catch-all segment is stored under the name "*".
+func (c *Context) Param(name string) string {
+	for i, n := range c.pnames {
+		if n == name && i < len(c.pvalues) {
+			return c.pvalues[i]
+		}
+	}
+	return ""
+}
+
+// ParamNames returns the names of param segments
+func (c *Context) ParamNames() []string {
+	return c.pnames
+}
+
+// ParamValues returns the values of param segments
+func (c *Context) ParamValues() []string {
+	return c.pvalues
+}
+
+// UserID returns the authenticated user id of the sender session
+func (c *Context) UserID() string {
+	userID, _ := cast.ToString(c.Get(UserID))
+	return userID
+}
+
+// Presence returns the presence of router, so handlers can check whether a user is online and find the sessions of user
+func (c *Context) Presence() Presence {
+	if c.hub == nil || c.hub.Router() == nil {
+		return nil
+	}
+	return c.hub.Router().presence
+}
+
 func (c *Context) Get(key string) interface{} {
 	return c.Event.Extensions()[key]
 }
@@ -47,6 +134,109 @@ func (c *Context) Set(key string, val interface{}) error {
 	return c.JSON("metadata.add", item)
 }
 
+// JoinRoom adds the sender session to the room
+func (c *Context) JoinRoom(roomID string) error {
+	err := ValidateRoomID(roomID)
+	if err != nil {
+		return err
+	}
+	return c.JSON("room.join", roomID)
+}
+
+// LeaveRoom removes the sender session from the room
+func (c *Context) LeaveRoom(roomID string) error {
+	return c.JSON("room.leave", roomID)
+}
+
+// WriteToRoom sends obj as JSON to all sessions in the room across all gateways
+func (c *Context) WriteToRoom(roomID string, eventType string, obj interface{}) error {
+	err := ValidateRoomID(roomID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	event, err := c.newEvent(eventType, cloudevents.ApplicationJSON, data)
+	if err != nil {
+		return err
+	}
+
+	topic := fmt.Sprintf("room.%s", roomID)
+	return c.hub.Publish(topic, event)
+}
+
+// WriteToUser sends obj as JSON to every session of the user across all gateways.  The sessions are found in the presence.  The
+// event is still written to the other sessions when it fails to be written to some sessions, and the returned error lists them.
+func (c *Context) WriteToUser(userID string, eventType string, obj interface{}, opts ...WriteOption) error {
+	o := writeOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	presence := c.Presence()
+	if presence == nil {
+		return ErrPresenceNotFound
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	event, err := c.newEvent(eventType, cloudevents.ApplicationJSON, data)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := presence.SessionsOf(userID)
+	if err != nil {
+		return err
+	}
+
+	// the event is written to the other sessions when it fails to be written to one session
+	var firstErr error
+	failed := []string{}
+	senderSessionID := c.SenderSessionID()
+	for _, session := range sessions {
+		if o.excludeSender && session.SessionID == senderSessionID {
+			continue
+		}
+
+		err = c.hub.Publish(NodeTopic(session.NodeID, session.SessionID), event)
+		if err != nil {
+			log.Err(err).Str("user_id", userID).Str("session_id", session.SessionID).Error("prelude: failed to write to session of user")
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed = append(failed, session.SessionID)
+		}
+	}
+
+	if firstErr != nil {
+		return fmt.Errorf("prelude: write to sessions %s of user failed: %w", strings.Join(failed, ","), firstErr)
+	}
+	return nil
+}
+
+// Broadcast sends obj as JSON to all sessions across all gateways
+func (c *Context) Broadcast(eventType string, obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	event, err := c.newEvent(eventType, cloudevents.ApplicationJSON, data)
+	if err != nil {
+		return err
+	}
+
+	return c.hub.Publish(BroadcastTopic, event)
+}
+
 func (c *Context) BindJSON(obj interface{}) error {
 	err := json.Unmarshal(c.Event.Data(), obj)
 	if err != nil {
@@ -56,41 +246,121 @@ func (c *Context) BindJSON(obj interface{}) error {
 }
 
 func (c *Context) Write(eventType string, contentType string, bytes []byte, sessionIDs ...string) error {
-	if eventType == "" {
-		return ErrInvalidEventType
+	event, err := c.newEvent(eventType, contentType, bytes)
+	if err != nil {
+		return err
 	}
 
-	event := cloudevents.NewEvent()
-	event.SetID(uuid.NewString())
-	event.SetSource(c.hub.Router().name)
-	event.SetTime(time.Now().UTC())
-	event.SetType(eventType)
+	if len(sessionIDs) == 0 {
+		sessionIDs = append(sessionIDs, c.SenderSessionID())
+	}
 
-	if len(bytes) > 0 {
-		err := event.SetData(contentType, bytes)
+	for _, sessionID := range sessionIDs {
+		topic, err := c.sessionTopic(sessionID)
+		if err != nil {
+			return err
+		}
+
+		err = c.hub.Publish(topic, event)
 		if err != nil {
 			return err
 		}
 	}
 
-	err := event.Validate()
+	return nil
+}
+
+// Reply sends obj as JSON to the sender of the current event.  The type of reply event is "<type>.reply" and its
+// correlation extension points to the id of the current event.  The reply is published to the topic of replyto extension
+// if the current event was sent by Huber.Request, otherwise it is sent back to the sender session.
+func (c *Context) Reply(obj interface{}) error {
+	return c.reply(c.Event.Type()+".reply", obj)
+}
+
+// reply sends obj as JSON event which is correlated to the current event to the requester or the sender session
+func (c *Context) reply(eventType string, obj interface{}) error {
+	data, err := json.Marshal(obj)
 	if err != nil {
 		return err
 	}
 
-	if len(sessionIDs) == 0 {
-		sessionIDs = append(sessionIDs, c.SenderSessionID())
+	event, err := c.newEvent(eventType, cloudevents.ApplicationJSON, data)
+	if err != nil {
+		return err
 	}
 
-	for _, sessionID := range sessionIDs {
-		topic := fmt.Sprintf("sess.%s", sessionID)
-		err := c.hub.Publish(topic, event)
+	err = event.Context.SetExtension(CorrelationID, c.Event.ID())
+	if err != nil {
+		return err
+	}
+
+	topic, _ := cast.ToString(c.Get(ReplyTo))
+	if topic == "" {
+		topic, err = c.sessionTopic(c.SenderSessionID())
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return c.hub.Publish(topic, event)
+}
+
+// hasSender returns true if the current event was sent by session or requester which can receive the reply
+func (c *Context) hasSender() bool {
+	replyTo, _ := cast.ToString(c.Get(ReplyTo))
+	return c.SenderSessionID() != "" || replyTo != ""
+}
+
+// sessionTopic returns the node topic of the session.  The node of sender session is taken from the nodeid extension and the nodes of
+// other sessions are looked up in the presence.  ErrSessionNotFound is returned if the session isn't registered in the presence.
+func (c *Context) sessionTopic(sessionID string) (string, error) {
+	if sessionID == c.SenderSessionID() {
+		nodeID, _ := cast.ToString(c.Get(NodeID))
+		if nodeID != "" {
+			return NodeTopic(nodeID, sessionID), nil
+		}
+	}
+
+	presence := c.Presence()
+	if presence == nil {
+		return "", ErrPresenceNotFound
+	}
+
+	info, err := presence.Lookup(sessionID)
+	if err != nil {
+		if _, inMemory := presence.(*MemoryPresence); inMemory && errors.Is(err, ErrSessionNotFound) {
+			return "", fmt.Errorf("%w: in-memory presence only knows the sessions of gateways in this process, "+
+				"the router must share the presence with gateways, e.g. NATS KV presence", err)
+		}
+		return "", err
+	}
+	return NodeTopic(info.NodeID, sessionID), nil
+}
+
+func (c *Context) newEvent(eventType string, contentType string, bytes []byte) (cloudevents.Event, error) {
+	if eventType == "" {
+		return cloudevents.Event{}, ErrInvalidEventType
+	}
+
+	event := cloudevents.NewEvent()
+	event.SetID(uuid.NewString())
+	event.SetSource(c.hub.Router().name)
+	event.SetTime(time.Now().UTC())
+	event.SetType(eventType)
+
+	if len(bytes) > 0 {
+		err := event.SetData(contentType, bytes)
+		if err != nil {
+			return cloudevents.Event{}, err
+		}
+	}
+
+	err := event.Validate()
+	if err != nil {
+		return cloudevents.Event{}, err
+	}
+
+	return event, nil
 }
 
 func (c *Context) JSON(eventType string, obj interface{}, sessionIDs ...string) error {
@@ -98,7 +368,7 @@ func (c *Context) JSON(eventType string, obj interface{}, sessionIDs ...string)
 	if err != nil {
 		return err
 	}
-	return c.Write(eventType, cloudevents.ApplicationJSON, data)
+	return c.Write(eventType, cloudevents.ApplicationJSON, data, sessionIDs...)
 }
 
 func (c *Context) XML(eventType string, obj interface{}, sessionIDs ...string) error {
@@ -106,7 +376,7 @@ func (c *Context) XML(eventType string, obj interface{}, sessionIDs ...string) e
 	if err != nil {
 		return err
 	}
-	return c.Write(eventType, cloudevents.ApplicationXML, data)
+	return c.Write(eventType, cloudevents.ApplicationXML, data, sessionIDs...)
 }
 
 func (c *Context) ProtoBuf(eventType string, msg proto.Message, sessionIDs ...string) error {
@@ -114,5 +384,5 @@ func (c *Context) ProtoBuf(eventType string, msg proto.Message, sessionIDs ...st
 	if err != nil {
 		return err
 	}
-	return c.Write(eventType, format.ContentTypeProtobuf, data)
+	return c.Write(eventType, format.ContentTypeProtobuf, data, sessionIDs...)
 }
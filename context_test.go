@@ -0,0 +1,91 @@
+package prelude
+
+import (
+	"errors"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestWriteToUserContinuesAfterFailure(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	errPublish := errors.New("publish failed")
+	hub := NewMockHuber(ctrl)
+	hub.EXPECT().SetRouter(gomock.Any())
+	router := NewRouter("prelude", hub)
+	hub.EXPECT().Router().Return(router).AnyTimes()
+
+	for _, sessionID := range []string{"session1", "session2", "session3"} {
+		err := router.Presence().Register(SessionInfo{SessionID: sessionID, UserID: "user1", NodeID: "node1"})
+		require.NoError(t, err)
+	}
+
+	hub.EXPECT().Publish(NodeTopic("node1", "session1"), gomock.Any()).Return(errPublish)
+	hub.EXPECT().Publish(NodeTopic("node1", "session2"), gomock.Any()).Return(nil)
+	hub.EXPECT().Publish(NodeTopic("node1", "session3"), gomock.Any()).Return(errPublish)
+
+	event := cloudevents.NewEvent()
+	event.SetID("1")
+	event.SetSource("client")
+	event.SetType("sync")
+	c := NewContext(hub, event)
+
+	err := c.WriteToUser("user1", "synced", "hello")
+	assert.ErrorIs(t, err, errPublish)
+	assert.Contains(t, err.Error(), "session1")
+	assert.Contains(t, err.Error(), "session3")
+	assert.NotContains(t, err.Error(), "session2")
+}
+
+func TestWriteToSessionIDs(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	hub := NewMockHuber(ctrl)
+	hub.EXPECT().SetRouter(gomock.Any())
+	router := NewRouter("prelude", hub)
+	hub.EXPECT().Router().Return(router).AnyTimes()
+
+	for _, sessionID := range []string{"sender", "session1"} {
+		err := router.Presence().Register(SessionInfo{SessionID: sessionID, NodeID: "node1"})
+		require.NoError(t, err)
+	}
+
+	event := cloudevents.NewEvent()
+	event.SetID("1")
+	event.SetSource("client")
+	event.SetType("sync")
+	event.SetExtension(SessionID, "sender")
+	c := NewContext(hub, event)
+
+	// the events are sent to the given sessions instead of the sender
+	hub.EXPECT().Publish(NodeTopic("node1", "session1"), gomock.Any()).Return(nil).Times(3)
+	require.NoError(t, c.JSON("synced", "hello", "session1"))
+	require.NoError(t, c.XML("synced", "hello", "session1"))
+	require.NoError(t, c.ProtoBuf("synced", wrapperspb.String("hello"), "session1"))
+}
+
+func TestWriteToInvalidRoom(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// nothing is published to the topics which no room subscribes
+	hub := NewMockHuber(ctrl)
+	event := cloudevents.NewEvent()
+	event.SetID("1")
+	event.SetSource("client")
+	event.SetType("chat")
+	c := NewContext(hub, event)
+
+	for _, roomID := range []string{"", "lobby.vip", "*", "lobby>", ":id"} {
+		assert.ErrorIs(t, c.WriteToRoom(roomID, "chat.message", "hello"), ErrInvalidRoomID, roomID)
+		assert.ErrorIs(t, c.JoinRoom(roomID), ErrInvalidRoomID, roomID)
+	}
+	assert.NoError(t, ValidateRoomID("lobby_vip-1"))
+}
@@ -0,0 +1,79 @@
+package prelude
+
+import (
+	"errors"
+	"strings"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/nite-coder/blackbear/pkg/log"
+)
+
+const (
+	// ErrorCodeInternal is the code of error which is sent to the sender when the handler returns an untyped error
+	ErrorCodeInternal = "internal"
+)
+
+// Error is the typed error which handlers return to tell the sender why its event failed.  It is sent back to the sender as
+// "<type>.error" event.
+type Error struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// NewError creates an error with code and message, e.g. NewError("room.full", "the room is full")
+func NewError(code string, message string) *Error {
+	return &Error{
+		Code:    code,
+		Message: message,
+	}
+}
+
+// WithDetails sets the details of error which are sent to the sender as well
+func (e *Error) WithDetails(details interface{}) *Error {
+	e.Details = details
+	return e
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// ErrorHandlerFunc handles the error which is returned by the handler of event
+type ErrorHandlerFunc func(c *Context, err error)
+
+// DefaultErrorHandler sends the error back to the sender as "<type>.error" event whose correlation extension points to the id of
+// the failed event.  Untyped errors are logged and sent as internal error, so the details of them aren't leaked to clients.
+func DefaultErrorHandler(c *Context, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		log.Err(err).Str("action", c.Event.Type()).Str("event_id", c.Event.ID()).Error("prelude: handler failed")
+		e = NewError(ErrorCodeInternal, "internal error")
+	}
+
+	if !c.hasSender() {
+		return
+	}
+
+	sendErr := c.reply(c.Event.Type()+".error", e)
+	if sendErr != nil {
+		log.Err(sendErr).Str("action", c.Event.Type()).Str("event_id", c.Event.ID()).Error("prelude: failed to send error event")
+	}
+}
+
+// ReplyError returns the error which the reply of Huber.Request carries, e.g. "<type>.error" event which is sent by DefaultErrorHandler
+// or route.not_found event.  It returns nil if the reply isn't an error.
+func ReplyError(reply cloudevents.Event) error {
+	switch {
+	case strings.HasSuffix(reply.Type(), ".error"):
+		e := &Error{}
+		err := reply.DataAs(e)
+		if err != nil || e.Code == "" {
+			return NewError(ErrorCodeInternal, "error reply is invalid")
+		}
+		return e
+	case reply.Type() == RouteNotFoundEventType:
+		return NewError(RouteNotFoundEventType, "route not found")
+	}
+	return nil
+}
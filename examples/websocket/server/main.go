@@ -1,6 +1,12 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/nite-coder/blackbear/pkg/config"
 	"github.com/nite-coder/blackbear/pkg/log"
 	"github.com/nite-coder/blackbear/pkg/log/handler/console"
@@ -39,9 +45,28 @@ func main() {
 		return nil
 	})
 
-	websocketGateway := websocket.NewGateway()
+	websocketGateway := websocket.NewGateway(websocket.WithConfig("websocket"))
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+
+		stopChan := make(chan os.Signal, 1)
+		signal.Notify(stopChan, syscall.SIGINT, syscall.SIGTERM)
+		<-stopChan
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := websocketGateway.Shutdown(ctx)
+		if err != nil {
+			log.Err(err).Error("main: websocket gateway shutdown failed")
+		}
+	}()
+
 	err = websocketGateway.ListenAndServe(":10080", hub)
 	if err != nil {
 		log.Err(err).Error("main: websocket gateway start failed")
+		return
 	}
+	<-shutdownDone
 }
@@ -1,12 +1,52 @@
 package prelude
 
-import "context"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
 
 const (
 	SessionID = "sessionid"
+	// UserID is the extension which contains the authenticated user id of the sender session
+	UserID = "userid"
+	// CorrelationID is the extension of reply event which points to the id of the request event
+	CorrelationID = "correlationid"
+	// ReplyTo is the extension of request event which contains the topic that reply event is published to
+	ReplyTo = "replyto"
+	// NodeID is the extension which contains the id of gateway node that the sender session is connected to
+	NodeID = "nodeid"
 )
 
-// Gatewayer handles all communications between client and server
+// BroadcastTopic is subscribed by every gateway and events which are published to it are pushed to all sessions
+const BroadcastTopic = "broadcast"
+
+// NodeTopicPrefix is the prefix of node topics.  Every gateway node subscribes "gw.<nodeID>.*" once and dispatches events
+// to its local sessions.
+const NodeTopicPrefix = "gw"
+
+// NodeTopic returns the topic of the session on the gateway node, e.g. "gw.<nodeID>.<sessionID>"
+func NodeTopic(nodeID string, sessionID string) string {
+	return fmt.Sprintf("%s.%s.%s", NodeTopicPrefix, nodeID, sessionID)
+}
+
+// ErrInvalidRoomID is returned when room id is empty, contains the token separator "." or wildcards "*" and ">" of topic, or
+// starts with ":"
+var ErrInvalidRoomID = errors.New("prelude: room id can't be empty, contain '.', '*' or '>', or start with ':'")
+
+// ValidateRoomID returns ErrInvalidRoomID if the room id isn't a single token of room topic "room.<id>".  Otherwise the route of
+// room matches the topics of other rooms or the events are published to topics which no room subscribes.  The leading ":" is
+// rejected as well because the router converts it to wildcard.
+func ValidateRoomID(roomID string) error {
+	if roomID == "" || strings.ContainsAny(roomID, ".*>") || strings.HasPrefix(roomID, ":") {
+		return ErrInvalidRoomID
+	}
+	return nil
+}
+
+// Gatewayer handles all communications between client and server.  ListenAndServe blocks until Shutdown is called or the gateway fails,
+// so the application decides how to handle OS signals.
 type Gatewayer interface {
 	ListenAndServe(bind string, hub Huber) error
 	Shutdown(ctx context.Context) error
@@ -0,0 +1,53 @@
+package websocket
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Identity represents the authenticated user of a websocket connection
+type Identity struct {
+	UserID string
+	Claims map[string]interface{}
+}
+
+// Authenticator authenticates the http request before it is upgraded to websocket connection.
+// The request is rejected if an error is returned.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// AuthenticatorFunc is an adapter to allow the use of ordinary functions as Authenticator
+type AuthenticatorFunc func(r *http.Request) (*Identity, error)
+
+// Authenticate calls f(r)
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*Identity, error) {
+	return f(r)
+}
+
+// AuthError rejects the upgrade request with specific http status code.  Other errors are rejected with 401 status code.
+type AuthError struct {
+	StatusCode int
+	Message    string
+}
+
+// NewAuthError returns an AuthError instance
+func NewAuthError(statusCode int, message string) *AuthError {
+	return &AuthError{
+		StatusCode: statusCode,
+		Message:    message,
+	}
+}
+
+func (e *AuthError) Error() string {
+	return "websocket: " + e.Message
+}
+
+// authErrorStatus returns http status code and message which are used to reject the upgrade request
+func authErrorStatus(err error) (int, string) {
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return authErr.StatusCode, authErr.Message
+	}
+	return http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized)
+}
@@ -0,0 +1,136 @@
+package websocket
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+// ErrQueueFull is returned when the event is dropped because the queue is full
+var ErrQueueFull = errors.New("websocket: queue is full")
+
+// BackpressurePolicy decides what happens when the outbound queues of session or the hub queue are full
+type BackpressurePolicy int
+
+const (
+	// DropNewest drops the event which is being enqueued.  It is the default policy.
+	DropNewest BackpressurePolicy = iota
+	// DropOldest drops the oldest events of the queue to make room for the new event
+	DropOldest
+	// Block waits until the queue has room.  The event is dropped when the backpressure timeout is reached.
+	Block
+	// Disconnect closes the session which can't keep up with the events
+	Disconnect
+)
+
+// String returns the name of policy which is used in config file
+func (p BackpressurePolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop_oldest"
+	case Block:
+		return "block"
+	case Disconnect:
+		return "disconnect"
+	default:
+		return "drop_newest"
+	}
+}
+
+// ParseBackpressurePolicy converts the name of policy, e.g. "drop_oldest", to BackpressurePolicy
+func ParseBackpressurePolicy(name string) (BackpressurePolicy, error) {
+	switch strings.ToLower(name) {
+	case "drop_newest", "":
+		return DropNewest, nil
+	case "drop_oldest":
+		return DropOldest, nil
+	case "block":
+		return Block, nil
+	case "disconnect":
+		return Disconnect, nil
+	default:
+		return DropNewest, errors.New("websocket: backpressure policy " + name + " is not supported")
+	}
+}
+
+// enqueueMessage puts the message into the queue by the policy.  It returns whether the message was enqueued and how many messages
+// were dropped.
+func enqueueMessage(queue chan *WSMessage, msg *WSMessage, policy BackpressurePolicy, timeout time.Duration) (bool, int) {
+	select {
+	case queue <- msg:
+		return true, 0
+	default:
+	}
+
+	switch policy {
+	case DropOldest:
+		dropped := 0
+		for {
+			select {
+			case queue <- msg:
+				return true, dropped
+			default:
+			}
+
+			select {
+			case <-queue:
+				dropped++
+			default:
+			}
+		}
+	case Block:
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case queue <- msg:
+			return true, 0
+		case <-timer.C:
+			return false, 1
+		}
+	default:
+		return false, 1
+	}
+}
+
+// enqueueEvent puts the event into the queue by the policy.  It returns whether the event was enqueued and how many events
+// were dropped.
+func enqueueEvent(queue chan cloudevents.Event, event cloudevents.Event, policy BackpressurePolicy, timeout time.Duration) (bool, int) {
+	select {
+	case queue <- event:
+		return true, 0
+	default:
+	}
+
+	switch policy {
+	case DropOldest:
+		dropped := 0
+		for {
+			select {
+			case queue <- event:
+				return true, dropped
+			default:
+			}
+
+			select {
+			case <-queue:
+				dropped++
+			default:
+			}
+		}
+	case Block:
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case queue <- event:
+			return true, 0
+		case <-timer.C:
+			return false, 1
+		}
+	default:
+		return false, 1
+	}
+}
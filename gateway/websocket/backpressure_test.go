@@ -0,0 +1,82 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/google/uuid"
+	"github.com/nite-coder/prelude/hub/channel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newBackpressureEvent(id string) cloudevents.Event {
+	event := cloudevents.NewEvent()
+	event.SetID(id)
+	event.SetSource("test")
+	event.SetType("hello")
+	return event
+}
+
+func TestEnqueueEvent(t *testing.T) {
+	queue := make(chan cloudevents.Event, 2)
+	_, _ = enqueueEvent(queue, newBackpressureEvent("1"), DropNewest, 0)
+	_, _ = enqueueEvent(queue, newBackpressureEvent("2"), DropNewest, 0)
+
+	enqueued, dropped := enqueueEvent(queue, newBackpressureEvent("3"), DropNewest, 0)
+	assert.False(t, enqueued)
+	assert.Equal(t, 1, dropped)
+
+	enqueued, dropped = enqueueEvent(queue, newBackpressureEvent("3"), DropOldest, 0)
+	assert.True(t, enqueued)
+	assert.Equal(t, 1, dropped)
+	assert.Equal(t, "2", (<-queue).ID())
+	assert.Equal(t, "3", (<-queue).ID())
+
+	_, _ = enqueueEvent(queue, newBackpressureEvent("4"), Block, 0)
+	_, _ = enqueueEvent(queue, newBackpressureEvent("5"), Block, 0)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-queue
+	}()
+	enqueued, dropped = enqueueEvent(queue, newBackpressureEvent("6"), Block, time.Second)
+	assert.True(t, enqueued)
+	assert.Equal(t, 0, dropped)
+
+	enqueued, dropped = enqueueEvent(queue, newBackpressureEvent("7"), Block, 10*time.Millisecond)
+	assert.False(t, enqueued)
+	assert.Equal(t, 1, dropped)
+}
+
+func TestBackpressurePolicy(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+
+	manager := NewManager(hub, WithSessionQueueSize(1, 1, 1))
+	session := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+	require.NoError(t, session.SendEvent(newBackpressureEvent("1")))
+	assert.ErrorIs(t, session.SendEvent(newBackpressureEvent("2")), ErrQueueFull)
+	assert.Equal(t, int64(1), manager.Status().DroppedEvents)
+	assert.Equal(t, int64(0), manager.Status().DisconnectedSessions)
+
+	manager = NewManager(hub, WithSessionQueueSize(1, 1, 1), WithBackpressure(Disconnect, 0))
+	session = NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+	session.SetActive(true)
+	require.NoError(t, session.SendEvent(newBackpressureEvent("1")))
+	assert.ErrorIs(t, session.SendEvent(newBackpressureEvent("2")), ErrQueueFull)
+	assert.Equal(t, int64(1), manager.Status().DroppedEvents)
+	assert.Equal(t, int64(1), manager.Status().DisconnectedSessions)
+
+	manager = NewManager(hub, WithHubQueueSize(1))
+	manager.SetActive(true)
+	require.NoError(t, manager.AddEventToHub(newBackpressureEvent("1")))
+	assert.ErrorIs(t, manager.AddEventToHub(newBackpressureEvent("2")), ErrQueueFull)
+	assert.Equal(t, int64(1), manager.Status().DroppedHubEvents)
+
+	policy, err := ParseBackpressurePolicy("drop_oldest")
+	require.NoError(t, err)
+	assert.Equal(t, DropOldest, policy)
+	_, err = ParseBackpressurePolicy("unknown")
+	assert.Error(t, err)
+}
@@ -34,20 +34,33 @@ func (b *Bucket) deleteSession(session *WSSession) {
 }
 
 func (b *Bucket) pushAll(event cloudevents.Event) {
-	var (
-		session *WSSession
-		ok      bool
-	)
+	// the event is encoded once for each subprotocol and the sessions of subprotocol which fails to encode the event are skipped
+	msgs := map[*codec]*WSMessage{}
+	errs := map[*codec]error{}
 
 	b.sessions.Range(func(key, value interface{}) bool {
-		session, ok = value.(*WSSession)
-		if ok {
-			msg, err := toWSMessage(event)
+		session, ok := value.(*WSSession)
+		if !ok {
+			return true
+		}
+
+		if _, failed := errs[session.codec]; failed {
+			return true
+		}
+
+		msg, found := msgs[session.codec]
+		if !found {
+			var err error
+			msg, err = session.codec.encode(event)
 			if err != nil {
+				log.Err(err).Str("subprotocol", session.codec.subprotocol).Str("action", event.Type()).Error("websocket: event to webscoket message fail")
+				errs[session.codec] = err
 				return true
 			}
-			session.sendMessage(msg)
+			msgs[session.codec] = msg
 		}
+
+		_ = session.sendMessage(msg)
 		return true
 	})
 }
@@ -74,6 +87,18 @@ func (b *Bucket) push(sessionID string, event cloudevents.Event) error {
 	return session.SendEvent(event)
 }
 
+func (b *Bucket) allSessions() []*WSSession {
+	sessions := []*WSSession{}
+	b.sessions.Range(func(_, value interface{}) bool {
+		session, ok := value.(*WSSession)
+		if ok {
+			sessions = append(sessions, session)
+		}
+		return true
+	})
+	return sessions
+}
+
 func (b *Bucket) count() int {
 	length := 0
 	b.sessions.Range(func(_, _ interface{}) bool {
@@ -0,0 +1,74 @@
+package websocket
+
+import (
+	"errors"
+
+	protobuf "github.com/cloudevents/sdk-go/binding/format/protobuf/v2"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding/format"
+	"github.com/gorilla/websocket"
+)
+
+// websocket subprotocols which are supported by the gateway
+const (
+	SubprotocolJSON     = "cloudevents.json"
+	SubprotocolProtobuf = "cloudevents.protobuf"
+)
+
+var (
+	// ErrUnsupportedMessageType is returned when the websocket message type doesn't match the negotiated subprotocol
+	ErrUnsupportedMessageType = errors.New("websocket: message type is not supported by subprotocol")
+
+	// subprotocols are ordered by server preference
+	subprotocols = []string{SubprotocolProtobuf, SubprotocolJSON}
+
+	codecs = map[string]*codec{
+		SubprotocolJSON: {
+			subprotocol: SubprotocolJSON,
+			format:      format.JSON,
+			msgType:     websocket.TextMessage,
+		},
+		SubprotocolProtobuf: {
+			subprotocol: SubprotocolProtobuf,
+			format:      protobuf.Protobuf,
+			msgType:     websocket.BinaryMessage,
+		},
+	}
+)
+
+// codec encodes and decodes events in the event format of negotiated subprotocol
+type codec struct {
+	subprotocol string
+	format      format.Format
+	msgType     int
+}
+
+// codecBySubprotocol returns the codec of subprotocol.  JSON codec is returned if the client didn't negotiate any subprotocol.
+func codecBySubprotocol(subprotocol string) *codec {
+	c, found := codecs[subprotocol]
+	if !found {
+		return codecs[SubprotocolJSON]
+	}
+	return c
+}
+
+func (c *codec) encode(event cloudevents.Event) (*WSMessage, error) {
+	buf, err := c.format.Marshal(&event)
+	if err != nil {
+		return nil, err
+	}
+	return &WSMessage{c.msgType, buf}, nil
+}
+
+func (c *codec) decode(msg *WSMessage) (cloudevents.Event, error) {
+	event := cloudevents.NewEvent()
+	if msg.MsgType != c.msgType {
+		return event, ErrUnsupportedMessageType
+	}
+
+	err := c.format.Unmarshal(msg.MsgData, &event)
+	if err != nil {
+		return event, err
+	}
+	return event, nil
+}
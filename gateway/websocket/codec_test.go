@@ -0,0 +1,88 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodec(t *testing.T) {
+	event := cloudevents.NewEvent()
+	event.SetID(uuid.NewString())
+	event.SetSource("client")
+	event.SetType("hello")
+	err := event.SetData(cloudevents.ApplicationJSON, []byte(`{"message":"hello world"}`))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		subprotocol string
+		msgType     int
+	}{
+		{"", websocket.TextMessage},
+		{SubprotocolJSON, websocket.TextMessage},
+		{SubprotocolProtobuf, websocket.BinaryMessage},
+	}
+
+	for _, tc := range testCases {
+		c := codecBySubprotocol(tc.subprotocol)
+
+		msg, err := c.encode(event)
+		require.NoError(t, err)
+		assert.Equal(t, tc.msgType, msg.MsgType)
+
+		decoded, err := c.decode(msg)
+		require.NoError(t, err)
+		assert.Equal(t, event.ID(), decoded.ID())
+		assert.Equal(t, event.Type(), decoded.Type())
+		assert.Equal(t, event.Data(), decoded.Data())
+	}
+
+	_, err = codecBySubprotocol(SubprotocolProtobuf).decode(&WSMessage{websocket.TextMessage, []byte("{}")})
+	assert.ErrorIs(t, err, ErrUnsupportedMessageType)
+}
+
+type failingFormat struct{}
+
+func (failingFormat) MediaType() string { return "application/failing" }
+func (failingFormat) Marshal(e *event.Event) ([]byte, error) {
+	return nil, errors.New("marshal failed")
+}
+func (failingFormat) Unmarshal(b []byte, e *event.Event) error { return errors.New("unmarshal failed") }
+
+func TestPushAllSkipsFailedCodec(t *testing.T) {
+	manager := NewManager(nil)
+	bucket := NewBucket(context.Background(), 0, 0)
+	failing := &codec{subprotocol: "failing", format: failingFormat{}, msgType: websocket.TextMessage}
+
+	sessions := []*WSSession{}
+	for i := 0; i < 10; i++ {
+		session := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+		if i%2 == 0 {
+			session.codec = failing
+		}
+		bucket.addSession(session)
+		sessions = append(sessions, session)
+	}
+
+	event := cloudevents.NewEvent()
+	event.SetID(uuid.NewString())
+	event.SetSource("server")
+	event.SetType("notice")
+	bucket.pushAll(event)
+
+	// only the sessions whose codec failed to encode the event miss it
+	for i, session := range sessions {
+		if i%2 == 0 {
+			assert.Len(t, session.outChan, 0)
+			continue
+		}
+		assert.Len(t, session.outChan, 1)
+	}
+}
@@ -0,0 +1,108 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nite-coder/blackbear/pkg/log"
+)
+
+// SessionEvictedEventType is the type of event which is published to hub when a slow session is evicted
+const SessionEvictedEventType = "session.evicted"
+
+// Eviction is the data of session.evicted event
+type Eviction struct {
+	SessionID      string `json:"session_id"`
+	UserID         string `json:"user_id,omitempty"`
+	Reason         string `json:"reason"`
+	QueueDepth     int    `json:"queue_depth"`
+	WriteLatencyMS int64  `json:"write_latency_ms"`
+}
+
+func (m *Manager) slowConsumerEnabled() bool {
+	return m.opts.slowQueueDepth > 0 || m.opts.slowWriteLatency > 0
+}
+
+// evictionLoop checks all sessions periodically and evicts the sessions which stay slow for the period
+func (m *Manager) evictionLoop() {
+	interval := m.opts.slowPeriod / 2
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			m.evictSlowSessions(now)
+		case <-m.stopChan:
+			return
+		}
+	}
+}
+
+func (m *Manager) evictSlowSessions(now time.Time) {
+	for _, bucket := range m.buckets {
+		for _, session := range bucket.allSessions() {
+			reason := m.slowReason(session, now)
+			if reason == "" {
+				session.slowSince = time.Time{}
+				continue
+			}
+
+			if session.slowSince.IsZero() {
+				session.slowSince = now
+			}
+
+			if now.Sub(session.slowSince) < m.opts.slowPeriod {
+				continue
+			}
+
+			m.evict(session, reason, now)
+		}
+	}
+}
+
+// slowReason returns the reason why the session is slow.  It returns empty string if the session is not slow.  Only the write in progress
+// and the writes which were completed in the slow period are checked.
+func (m *Manager) slowReason(session *WSSession, now time.Time) string {
+	if m.opts.slowQueueDepth > 0 && session.QueueDepth() > m.opts.slowQueueDepth {
+		return "queue_depth_exceeded"
+	}
+
+	if m.opts.slowWriteLatency > 0 && m.writeLatency(session, now) > m.opts.slowWriteLatency {
+		return "write_latency_exceeded"
+	}
+
+	return ""
+}
+
+func (m *Manager) writeLatency(session *WSSession, now time.Time) time.Duration {
+	return session.recentWriteLatency(now, now.Add(-m.opts.slowPeriod))
+}
+
+func (m *Manager) evict(session *WSSession, reason string, now time.Time) {
+	eviction := Eviction{
+		SessionID:      session.ID(),
+		Reason:         reason,
+		QueueDepth:     session.QueueDepth(),
+		WriteLatencyMS: m.writeLatency(session, now).Milliseconds(),
+	}
+	if identity := session.Identity(); identity != nil {
+		eviction.UserID = identity.UserID
+	}
+
+	log.Str("session_id", session.ID()).Str("reason", reason).Warn("websocket: slow session is evicted")
+	m.status.increaseEvictedSessions()
+	session.setCloseCode(websocket.CloseTryAgainLater)
+	_ = session.Close()
+
+	event, err := m.newSessionEvent(SessionEvictedEventType, session, eviction)
+	if err != nil {
+		log.Err(err).Error("websocket: session.evicted event is invalid")
+		return
+	}
+	m.publishEvent(event)
+}
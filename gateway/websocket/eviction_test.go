@@ -0,0 +1,89 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nite-coder/prelude"
+	"github.com/nite-coder/prelude/hub/channel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvictSlowSessions(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+	manager := NewManager(hub, WithSessionQueueSize(4, 4, 4), WithSlowConsumerEviction(2, time.Second, time.Minute))
+	manager.SetActive(true)
+	go manager.eventLoop()
+
+	evictions := make(chan Eviction, 1)
+	router.AddRoute(SessionEvictedEventType, func(c *prelude.Context) error {
+		eviction := Eviction{}
+		err := c.Event.DataAs(&eviction)
+		require.NoError(t, err)
+		evictions <- eviction
+		return nil
+	})
+
+	slow := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+	slow.SetIdentity(&Identity{UserID: "user1"})
+	slow.SetActive(true)
+	require.NoError(t, manager.AddSession(slow))
+
+	fast := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+	fast.SetActive(true)
+	require.NoError(t, manager.AddSession(fast))
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, slow.sendMessage(&WSMessage{MsgData: []byte("hello")}))
+	}
+
+	now := time.Now()
+	manager.evictSlowSessions(now)
+	assert.True(t, slow.IsActive())
+
+	manager.evictSlowSessions(now.Add(time.Minute))
+	assert.False(t, slow.IsActive())
+	assert.True(t, fast.IsActive())
+	assert.Equal(t, int64(1), manager.Status().EvictedSessions)
+
+	select {
+	case eviction := <-evictions:
+		assert.Equal(t, slow.ID(), eviction.SessionID)
+		assert.Equal(t, "user1", eviction.UserID)
+		assert.Equal(t, "queue_depth_exceeded", eviction.Reason)
+		assert.Equal(t, 3, eviction.QueueDepth)
+	case <-time.After(time.Second):
+		t.Fatal("session.evicted event was not published")
+	}
+
+	// the write which is in progress counts as write latency
+	fast.writeStartedAt = now.Add(-2 * time.Second).UnixNano()
+	assert.Equal(t, "write_latency_exceeded", manager.slowReason(fast, now))
+}
+
+func TestSlowWriteFollowedByFastWrite(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	_ = prelude.NewRouter("prelude", hub)
+	manager := NewManager(hub, WithSlowConsumerEviction(0, time.Second, time.Minute))
+
+	session := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+	now := time.Now()
+
+	// slow write
+	session.writeLatency = int64(2 * time.Second)
+	session.writeFinishedAt = now.Add(-time.Second).UnixNano()
+	assert.Equal(t, "write_latency_exceeded", manager.slowReason(session, now))
+
+	// fast write
+	session.writeLatency = int64(time.Millisecond)
+	session.writeFinishedAt = now.UnixNano()
+	assert.Equal(t, "", manager.slowReason(session, now))
+
+	// the slow write is older than slow period while the session is idle
+	session.writeLatency = int64(2 * time.Second)
+	session.writeFinishedAt = now.Add(-time.Second).UnixNano()
+	assert.Equal(t, "", manager.slowReason(session, now.Add(2*time.Minute)))
+}
@@ -4,10 +4,8 @@ import (
 	"context"
 	"errors"
 	"net/http"
-	"os"
-	"os/signal"
+	"sync"
 	"syscall"
-	"time"
 
 	"github.com/nite-coder/blackbear/pkg/log"
 	"github.com/nite-coder/blackbear/pkg/web"
@@ -15,16 +13,35 @@ import (
 	"github.com/nite-coder/prelude"
 )
 
+var _ prelude.Gatewayer = (*Gateway)(nil)
+
 // Gateway handles all websocket connections between client and server
 type Gateway struct {
+	mutex   sync.Mutex
 	manager *Manager
+	server  *web.WebServer
+	opts    []Option
+	// closed is set by Shutdown, so ListenAndServe which is called or still starting after Shutdown doesn't serve
+	closed bool
 }
 
 // NewGateway returns a Gateway instance
-func NewGateway() prelude.Gatewayer {
-	return &Gateway{}
+func NewGateway(opts ...Option) *Gateway {
+	return &Gateway{
+		opts: opts,
+	}
+}
+
+// SetAuthenticator sets the authenticator which authenticates every websocket upgrade request.  It must be called before ListenAndServe.
+// It is the same as NewGateway(WithAuthenticator(authenticator)).
+func (g *Gateway) SetAuthenticator(authenticator Authenticator) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.opts = append(g.opts, WithAuthenticator(authenticator))
 }
 
+// ListenAndServe serves websocket connections on the bind address.  It blocks until Shutdown is called or the listener fails.
+// It returns nil if the gateway was stopped by Shutdown, even if Shutdown was called before ListenAndServe.
 func (g *Gateway) ListenAndServe(bind string, hub prelude.Huber) error {
 	// Increase resources limitations
 	var rLimit syscall.Rlimit
@@ -36,11 +53,11 @@ func (g *Gateway) ListenAndServe(bind string, hub prelude.Huber) error {
 		return err
 	}
 
-	g.manager = NewManager(hub)
+	manager := NewManager(hub, g.opts...)
 
 	s := web.NewServer()
 	corsOpts := middleware.Options{
-		AllowedOrigins: []string{"*"},
+		AllowedOrigins: manager.opts.allowedOrigins,
 		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "PATCH"},
 		AllowedHeaders: []string{"*"},
 	}
@@ -52,45 +69,65 @@ func (g *Gateway) ListenAndServe(bind string, hub prelude.Huber) error {
 		return nil
 	})
 
-	gatewayHTTPhandler := NewGatewayHTTPHandler(g.manager)
+	gatewayHTTPhandler := NewGatewayHTTPHandler(manager)
 	s = RegisterRoute(s, gatewayHTTPhandler)
 
-	go func() {
-		// service connections
-		log.Infof("websocket: Listening and serving HTTP on %s\n", bind)
-		err := s.Run(bind)
-		if errors.Is(err, http.ErrServerClosed) {
-			log.Infof("websocket: http server closed under request: %v", err)
-		} else {
-			log.Fatalf("websocket: http server closed unexpect: %v", err)
-		}
-	}()
+	// the manager is started under the lock, so Shutdown either stops the gateway before it serves or shuts down the started manager
+	g.mutex.Lock()
+	if g.closed {
+		g.mutex.Unlock()
+		log.Info("websocket: gateway was shut down before serving")
+		return nil
+	}
+	g.manager = manager
+	g.server = s
+	err := manager.Start()
+	g.mutex.Unlock()
+	if err != nil {
+		return err
+	}
 
-	go func() {
-		_ = g.manager.Start()
-	}()
+	log.Infof("websocket: Listening and serving HTTP on %s\n", bind)
+	err = s.Run(bind)
+	if errors.Is(err, http.ErrServerClosed) {
+		log.Info("websocket: http server closed under request")
+		return nil
+	}
+
+	log.Err(err).Error("websocket: http server closed unexpectedly")
+	_ = manager.Shutdown(context.Background())
+	return err
+}
+
+// Shutdown gracefully stops the gateway.  ListenAndServe returns after Shutdown is called and it doesn't serve if Shutdown is called first.
+func (g *Gateway) Shutdown(ctx context.Context) error {
+	g.mutex.Lock()
+	g.closed = true
+	manager, server := g.manager, g.server
+	g.mutex.Unlock()
+
+	if manager == nil {
+		return nil
+	}
 
-	stopChan := make(chan os.Signal, 1)
-	signal.Notify(stopChan, syscall.SIGINT, syscall.SIGTERM)
-	<-stopChan
 	log.Info("websocket: shutting down server...")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	if err := g.manager.Shutdown(ctx); err != nil {
+	var result error
+	if err := manager.Shutdown(ctx); err != nil {
 		log.Errorf("websocket: gateway manager shutdown error: %v", err)
+		result = err
 	} else {
 		log.Info("websocket: gateway manager gracefully stopped")
 	}
 
-	if err := s.Shutdown(ctx); err != nil {
+	if err := server.Shutdown(ctx); err != nil {
 		log.Errorf("websocket: web server shutdown error: %v", err)
+		if result == nil {
+			result = err
+		}
 	} else {
 		log.Info("websocket: web server gracefully stopped")
 	}
-	return nil
-}
 
-func (g *Gateway) Shutdown(ctx context.Context) error {
-	return g.manager.Shutdown(ctx)
+	return result
 }
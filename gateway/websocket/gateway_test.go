@@ -12,7 +12,7 @@ import (
 	cloudevents "github.com/cloudevents/sdk-go/v2"
 	"github.com/google/uuid"
 	"github.com/nite-coder/prelude"
-	"github.com/nite-coder/prelude/hub/nats"
+	"github.com/nite-coder/prelude/hub/channel"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -20,11 +20,7 @@ import (
 func TestGateway(t *testing.T) {
 	ctx := context.Background()
 
-	opts := nats.HubOptions{
-		URL: "nats://host.docker.internal:4222",
-	}
-	hub, err := nats.NewNatsHub(opts)
-	require.Nil(t, err)
+	hub := channel.NewChannelHub(channel.HubOptions{})
 
 	var wg sync.WaitGroup
 	wg.Add(3)
@@ -52,10 +48,14 @@ func TestGateway(t *testing.T) {
 		return nil
 	})
 
+	websocketGateway := NewGateway()
 	go func() {
-		websocketGateway := NewGateway()
 		err := websocketGateway.ListenAndServe("127.0.0.1:10085", hub)
-		require.Nil(t, err)
+		assert.Nil(t, err)
+	}()
+	defer func() {
+		err := websocketGateway.Shutdown(ctx)
+		assert.Nil(t, err)
 	}()
 
 	time.Sleep(1 * time.Second)
@@ -10,16 +10,6 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-var (
-	upgrader = websocket.Upgrader{
-		ReadBufferSize:  4096,
-		WriteBufferSize: 4096,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
-)
-
 // RegisterRoute return a router which handles all topics
 func RegisterRoute(server *web.WebServer, handler *GatewayHTTPHandler) *web.WebServer {
 	server.Get("/", handler.wsEndpoint)
@@ -29,13 +19,22 @@ func RegisterRoute(server *web.WebServer, handler *GatewayHTTPHandler) *web.WebS
 
 // GatewayHTTPHandler 用來是 Gateway http 的 handler
 type GatewayHTTPHandler struct {
-	manager *Manager
+	manager       *Manager
+	upgrader      websocket.Upgrader
+	authenticator Authenticator
 }
 
 // NewGatewayHTTPHandler 產生一個 GatewayHttpHander instance
 func NewGatewayHTTPHandler(manager *Manager) *GatewayHTTPHandler {
 	return &GatewayHTTPHandler{
 		manager: manager,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  manager.opts.readBufferSize,
+			WriteBufferSize: manager.opts.writeBufferSize,
+			Subprotocols:    subprotocols,
+			CheckOrigin:     manager.opts.checkOrigin,
+		},
+		authenticator: manager.opts.authenticator,
 	}
 }
 
@@ -47,9 +46,22 @@ func (h *GatewayHTTPHandler) wsEndpoint(c *web.Context) error {
 		logger.Debug("websocket: wsEndpoint end")
 	}()
 
-	respHeader := http.Header{}
-	respHeader["Sec-WebSocket-Protocol"] = []string{"cloudevents.json"}
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, respHeader)
+	if !h.manager.IsActive() {
+		return c.String(http.StatusServiceUnavailable, "server is shutting down")
+	}
+
+	var identity *Identity
+	if h.authenticator != nil {
+		var err error
+		identity, err = h.authenticator.Authenticate(c.Request)
+		if err != nil {
+			statusCode, message := authErrorStatus(err)
+			logger.Err(err).Str("client_ip", c.ClientIP()).Debug("websocket: authentication failed")
+			return c.String(statusCode, message)
+		}
+	}
+
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		return err
 	}
@@ -57,6 +69,9 @@ func (h *GatewayHTTPHandler) wsEndpoint(c *web.Context) error {
 	sessionID := uuid.NewString()
 	clientIP := c.ClientIP()
 	wsSession := NewWSSession(sessionID, clientIP, conn, h.manager)
+	if identity != nil {
+		wsSession.SetIdentity(identity)
+	}
 	return wsSession.Start()
 }
 
@@ -0,0 +1,393 @@
+package websocket
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// JWT signing algorithms which are supported by JWTAuthenticator
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+var (
+	errTokenNotFound     = NewAuthError(http.StatusUnauthorized, "token not found")
+	errTokenMalformed    = NewAuthError(http.StatusUnauthorized, "token is malformed")
+	errTokenAlgorithm    = NewAuthError(http.StatusUnauthorized, "token algorithm is not allowed")
+	errTokenKeyNotFound  = NewAuthError(http.StatusUnauthorized, "token key not found")
+	errTokenSignature    = NewAuthError(http.StatusUnauthorized, "token signature is invalid")
+	errTokenExpired      = NewAuthError(http.StatusUnauthorized, "token is expired")
+	errTokenNotValidYet  = NewAuthError(http.StatusUnauthorized, "token is not valid yet")
+	errTokenIssuer       = NewAuthError(http.StatusUnauthorized, "token issuer is invalid")
+	errTokenAudience     = NewAuthError(http.StatusUnauthorized, "token audience is invalid")
+	errTokenUserNotFound = NewAuthError(http.StatusUnauthorized, "token user id not found")
+)
+
+// JWTOptions is the options of JWTAuthenticator
+type JWTOptions struct {
+	// Keys are the static keys which verify tokens and they are indexed by key id.  The key with empty key id is used when the token
+	// doesn't have kid header.  The key must be []byte for HS256, *rsa.PublicKey for RS256 and *ecdsa.PublicKey for ES256.
+	Keys map[string]interface{}
+	// JWKSFile is the path of JSON Web Key Set file.  The keys of file are merged with Keys.
+	JWKSFile string
+	// Algorithms are the allowed signing algorithms.  Default is HS256, RS256 and ES256.
+	Algorithms []string
+	// Issuer is checked against iss claim if it is not empty
+	Issuer string
+	// Audience is checked against aud claim if it is not empty
+	Audience string
+	// Leeway is the allowed clock skew when exp and nbf claims are checked
+	Leeway time.Duration
+	// UserIDClaim is the claim which contains user id.  Default is sub.
+	UserIDClaim string
+	// Claims maps claim names to session metadata keys, e.g. {"preferred_username": "username"}.  Metadata keys must be valid
+	// CloudEvents extension names because metadata are added to every inbound event as extensions.
+	Claims map[string]string
+	// QueryParam is the query string parameter which contains the token when Authorization header is absent.  Default is token.
+	QueryParam string
+}
+
+// JWTAuthenticator authenticates websocket upgrade requests with JSON Web Token which is sent by "Authorization: Bearer <token>"
+// header or query string parameter
+type JWTAuthenticator struct {
+	opts       JWTOptions
+	keys       map[string]interface{}
+	algorithms map[string]bool
+}
+
+// NewJWTAuthenticator returns a JWTAuthenticator instance
+func NewJWTAuthenticator(opts JWTOptions) (*JWTAuthenticator, error) {
+	if opts.UserIDClaim == "" {
+		opts.UserIDClaim = "sub"
+	}
+
+	if opts.QueryParam == "" {
+		opts.QueryParam = "token"
+	}
+
+	if len(opts.Algorithms) == 0 {
+		opts.Algorithms = []string{HS256, RS256, ES256}
+	}
+
+	a := &JWTAuthenticator{
+		opts:       opts,
+		keys:       map[string]interface{}{},
+		algorithms: map[string]bool{},
+	}
+
+	for _, alg := range opts.Algorithms {
+		a.algorithms[alg] = true
+	}
+
+	for kid, key := range opts.Keys {
+		a.keys[kid] = key
+	}
+
+	if opts.JWKSFile != "" {
+		keys, err := loadJWKSFile(opts.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		for kid, key := range keys {
+			a.keys[kid] = key
+		}
+	}
+
+	if len(a.keys) == 0 {
+		return nil, errors.New("websocket: jwt authenticator requires at least one key")
+	}
+
+	return a, nil
+}
+
+// Authenticate verifies the token of request and returns the identity which contains user id and mapped claims
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := tokenFromRequest(r, a.opts.QueryParam)
+	if token == "" {
+		return nil, errTokenNotFound
+	}
+
+	claims, err := a.verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, ok := claims[a.opts.UserIDClaim].(string)
+	if !ok || userID == "" {
+		return nil, errTokenUserNotFound
+	}
+
+	identity := &Identity{
+		UserID: userID,
+		Claims: map[string]interface{}{},
+	}
+
+	for claim, key := range a.opts.Claims {
+		val, found := claims[claim]
+		if found {
+			identity.Claims[key] = val
+		}
+	}
+
+	return identity, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (a *JWTAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errTokenMalformed
+	}
+
+	header := jwtHeader{}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, errTokenMalformed
+	}
+
+	if !a.algorithms[header.Alg] {
+		return nil, errTokenAlgorithm
+	}
+
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errTokenMalformed
+	}
+
+	err = verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{}
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, errTokenMalformed
+	}
+
+	err = a.validateClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (a *JWTAuthenticator) key(kid string) (interface{}, error) {
+	key, found := a.keys[kid]
+	if found {
+		return key, nil
+	}
+
+	// the only key is used when the token doesn't have kid header
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, nil
+		}
+	}
+
+	return nil, errTokenKeyNotFound
+}
+
+func (a *JWTAuthenticator) validateClaims(claims map[string]interface{}) error {
+	now := time.Now()
+
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.After(time.Unix(int64(exp), 0).Add(a.opts.Leeway)) {
+			return errTokenExpired
+		}
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(a.opts.Leeway).Before(time.Unix(int64(nbf), 0)) {
+			return errTokenNotValidYet
+		}
+	}
+
+	if a.opts.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != a.opts.Issuer {
+			return errTokenIssuer
+		}
+	}
+
+	if a.opts.Audience != "" && !containsAudience(claims["aud"], a.opts.Audience) {
+		return errTokenAudience
+	}
+
+	return nil
+}
+
+func containsAudience(aud interface{}, audience string) bool {
+	switch val := aud.(type) {
+	case string:
+		return val == audience
+	case []interface{}:
+		for _, element := range val {
+			if s, ok := element.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func verifySignature(alg string, key interface{}, signingInput string, signature []byte) error {
+	hash := sha256.Sum256([]byte(signingInput))
+
+	switch alg {
+	case HS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return errTokenKeyNotFound
+		}
+		mac := hmac.New(sha256.New, secret)
+		_, _ = mac.Write([]byte(signingInput))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errTokenSignature
+		}
+	case RS256:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errTokenKeyNotFound
+		}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], signature) != nil {
+			return errTokenSignature
+		}
+	case ES256:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errTokenKeyNotFound
+		}
+		if len(signature) != 64 {
+			return errTokenSignature
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, hash[:], r, s) {
+			return errTokenSignature
+		}
+	default:
+		return errTokenAlgorithm
+	}
+
+	return nil
+}
+
+func tokenFromRequest(r *http.Request, queryParam string) string {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	return r.URL.Query().Get(queryParam)
+}
+
+func decodeSegment(segment string, obj interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, obj)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// loadJWKSFile reads RSA, EC (P-256) and oct keys from JSON Web Key Set file
+func loadJWKSFile(path string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	set := jsonWebKeySet{}
+	err = json.Unmarshal(b, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("websocket: jwk %s is invalid: %w", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("curve %s is not supported", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(jwk.K)
+	default:
+		return nil, fmt.Errorf("key type %s is not supported", jwk.Kty)
+	}
+}
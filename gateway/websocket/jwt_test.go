@@ -0,0 +1,180 @@
+package websocket
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signToken(t *testing.T, alg string, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+
+	headerBytes, err := json.Marshal(header)
+	require.NoError(t, err)
+	claimsBytes, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerBytes) + "." + base64.RawURLEncoding.EncodeToString(claimsBytes)
+	hash := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		_, _ = mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, hash[:])
+		require.NoError(t, err)
+		signature = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rb):32], rb)
+		copy(signature[64-len(sb):], sb)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newTokenRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestJWTAuthenticatorHS256(t *testing.T) {
+	secret := []byte("secret")
+	auth, err := NewJWTAuthenticator(JWTOptions{
+		Keys:     map[string]interface{}{"": secret},
+		Issuer:   "prelude",
+		Audience: "gateway",
+		Claims:   map[string]string{"role": "role"},
+	})
+	require.NoError(t, err)
+
+	claims := map[string]interface{}{
+		"sub":  "user1",
+		"iss":  "prelude",
+		"aud":  []string{"gateway"},
+		"role": "admin",
+		"exp":  time.Now().Add(time.Minute).Unix(),
+	}
+
+	identity, err := auth.Authenticate(newTokenRequest(signToken(t, HS256, "", secret, claims)))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", identity.UserID)
+	assert.Equal(t, map[string]interface{}{"role": "admin"}, identity.Claims)
+
+	// token from query string
+	r := httptest.NewRequest(http.MethodGet, "/?token="+signToken(t, HS256, "", secret, claims), nil)
+	identity, err = auth.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", identity.UserID)
+
+	// wrong secret
+	_, err = auth.Authenticate(newTokenRequest(signToken(t, HS256, "", []byte("wrong"), claims)))
+	assert.ErrorIs(t, err, errTokenSignature)
+
+	// expired token
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	_, err = auth.Authenticate(newTokenRequest(signToken(t, HS256, "", secret, claims)))
+	assert.ErrorIs(t, err, errTokenExpired)
+
+	// wrong audience
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+	claims["aud"] = "other"
+	_, err = auth.Authenticate(newTokenRequest(signToken(t, HS256, "", secret, claims)))
+	assert.ErrorIs(t, err, errTokenAudience)
+
+	// no token
+	_, err = auth.Authenticate(httptest.NewRequest(http.MethodGet, "/", nil))
+	statusCode, _ := authErrorStatus(err)
+	assert.Equal(t, http.StatusUnauthorized, statusCode)
+}
+
+func TestJWTAuthenticatorRS256AndES256(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	auth, err := NewJWTAuthenticator(JWTOptions{
+		Keys: map[string]interface{}{
+			"rsa": &rsaKey.PublicKey,
+			"ec":  &ecKey.PublicKey,
+		},
+		Algorithms: []string{RS256, ES256},
+	})
+	require.NoError(t, err)
+
+	claims := map[string]interface{}{"sub": "user1"}
+
+	identity, err := auth.Authenticate(newTokenRequest(signToken(t, RS256, "rsa", rsaKey, claims)))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", identity.UserID)
+
+	identity, err = auth.Authenticate(newTokenRequest(signToken(t, ES256, "ec", ecKey, claims)))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", identity.UserID)
+
+	// the algorithm and key type must match
+	_, err = auth.Authenticate(newTokenRequest(signToken(t, ES256, "rsa", ecKey, claims)))
+	assert.ErrorIs(t, err, errTokenKeyNotFound)
+
+	// HS256 is not allowed
+	_, err = auth.Authenticate(newTokenRequest(signToken(t, HS256, "rsa", []byte("secret"), claims)))
+	assert.ErrorIs(t, err, errTokenAlgorithm)
+}
+
+func TestJWTAuthenticatorJWKSFile(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	set := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "key1",
+				"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+		},
+	}
+	b, err := json.Marshal(set)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	err = ioutil.WriteFile(path, b, 0600)
+	require.NoError(t, err)
+
+	auth, err := NewJWTAuthenticator(JWTOptions{JWKSFile: path})
+	require.NoError(t, err)
+
+	identity, err := auth.Authenticate(newTokenRequest(signToken(t, RS256, "key1", rsaKey, map[string]interface{}{"sub": "user1"})))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", identity.UserID)
+
+	_, err = auth.Authenticate(newTokenRequest(signToken(t, RS256, "key2", rsaKey, map[string]interface{}{"sub": "user1"})))
+	assert.ErrorIs(t, err, errTokenKeyNotFound)
+}
@@ -0,0 +1,74 @@
+package websocket
+
+import (
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/google/uuid"
+	"github.com/nite-coder/blackbear/pkg/log"
+	"github.com/nite-coder/prelude"
+)
+
+// The types of lifecycle events which are published to hub when a session is connected or disconnected
+const (
+	SessionConnectedEventType    = "session.connected"
+	SessionDisconnectedEventType = "session.disconnected"
+)
+
+// SessionLifecycle is the data of session.connected and session.disconnected events
+type SessionLifecycle struct {
+	SessionID   string                 `json:"session_id"`
+	UserID      string                 `json:"user_id,omitempty"`
+	ClientIP    string                 `json:"client_ip"`
+	Gateway     string                 `json:"gateway"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	ConnectedAt time.Time              `json:"connected_at"`
+	// CloseCode and DurationMS are only set in session.disconnected event
+	CloseCode  int   `json:"close_code,omitempty"`
+	DurationMS int64 `json:"duration_ms,omitempty"`
+}
+
+// publishLifecycleEvent publishes session.connected or session.disconnected event of the session to hub
+func (m *Manager) publishLifecycleEvent(eventType string, session *WSSession) {
+	lifecycle := SessionLifecycle{
+		SessionID:   session.ID(),
+		ClientIP:    session.clientIP,
+		Gateway:     m.hostname,
+		Metadata:    session.Metadata(),
+		ConnectedAt: session.connectedAt,
+	}
+	if identity := session.Identity(); identity != nil {
+		lifecycle.UserID = identity.UserID
+	}
+
+	if eventType == SessionDisconnectedEventType {
+		lifecycle.CloseCode = session.CloseCode()
+		lifecycle.DurationMS = time.Since(session.connectedAt).Milliseconds()
+	}
+
+	event, err := m.newSessionEvent(eventType, session, lifecycle)
+	if err != nil {
+		log.Err(err).Str("type", eventType).Error("websocket: lifecycle event is invalid")
+		return
+	}
+	m.publishEvent(event)
+}
+
+// newSessionEvent returns the event which is published by gateway on behalf of the session
+func (m *Manager) newSessionEvent(eventType string, session *WSSession, data interface{}) (cloudevents.Event, error) {
+	event := cloudevents.NewEvent()
+	event.SetID(uuid.NewString())
+	event.SetSource(m.hostname)
+	event.SetTime(time.Now().UTC())
+	event.SetType(eventType)
+	event.SetExtension(prelude.SessionID, session.ID())
+	if identity := session.Identity(); identity != nil {
+		event.SetExtension(prelude.UserID, identity.UserID)
+	}
+
+	err := event.SetData(cloudevents.ApplicationJSON, data)
+	if err != nil {
+		return event, err
+	}
+	return event, nil
+}
@@ -0,0 +1,67 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/nite-coder/prelude"
+	"github.com/nite-coder/prelude/hub/channel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLifecycleEvents(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+	manager := NewManager(hub)
+
+	lifecycles := make(chan SessionLifecycle, 2)
+	handler := func(c *prelude.Context) error {
+		lifecycle := SessionLifecycle{}
+		err := c.Event.DataAs(&lifecycle)
+		require.NoError(t, err)
+		assert.Equal(t, lifecycle.SessionID, c.SenderSessionID())
+		assert.Equal(t, "user1", c.UserID())
+		lifecycles <- lifecycle
+		return nil
+	}
+	router.AddRoute(SessionConnectedEventType, handler)
+	router.AddRoute(SessionDisconnectedEventType, handler)
+
+	session := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+	session.SetIdentity(&Identity{UserID: "user1", Claims: map[string]interface{}{"role": "admin"}})
+	session.SetActive(true)
+	require.NoError(t, manager.AddSession(session))
+	manager.publishLifecycleEvent(SessionConnectedEventType, session)
+
+	select {
+	case lifecycle := <-lifecycles:
+		assert.Equal(t, session.ID(), lifecycle.SessionID)
+		assert.Equal(t, "127.0.0.1", lifecycle.ClientIP)
+		assert.Equal(t, "admin", lifecycle.Metadata["role"])
+		assert.Equal(t, 0, lifecycle.CloseCode)
+	case <-time.After(time.Second):
+		t.Fatal("session.connected event was not published")
+	}
+
+	require.NoError(t, manager.UpdateRouteInfo(session))
+	session.registered = true
+
+	session.setCloseCode(websocket.CloseGoingAway)
+	require.NoError(t, session.Close())
+
+	select {
+	case lifecycle := <-lifecycles:
+		assert.Equal(t, session.ID(), lifecycle.SessionID)
+		assert.Equal(t, websocket.CloseGoingAway, lifecycle.CloseCode)
+		assert.GreaterOrEqual(t, lifecycle.DurationMS, int64(0))
+	case <-time.After(time.Second):
+		t.Fatal("session.disconnected event was not published")
+	}
+
+	// the session is deregistered on close
+	_, err := router.Presence().Lookup(session.ID())
+	assert.ErrorIs(t, err, prelude.ErrSessionNotFound)
+}
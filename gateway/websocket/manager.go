@@ -2,8 +2,8 @@ package websocket
 
 import (
 	"context"
-	"encoding/json"
 	"hash/fnv"
+	"math/rand"
 	"os"
 	"sync"
 	"sync/atomic"
@@ -11,49 +11,59 @@ import (
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
 	"github.com/google/uuid"
-	"github.com/nite-coder/blackbear/pkg/config"
 	"github.com/nite-coder/blackbear/pkg/log"
 	"github.com/nite-coder/prelude"
 )
 
-var fnvHash32 = fnv.New32a()
+var (
+	// ErrInvalidRoomID is returned when room id isn't valid.  It is the same as prelude.ErrInvalidRoomID.
+	ErrInvalidRoomID = prelude.ErrInvalidRoomID
+)
 
 // FNV32a 用來做切片 string -> int32
 func FNV32a(s string) uint32 {
-	_, _ = fnvHash32.Write([]byte(s))
-	defer fnvHash32.Reset()
-
-	return fnvHash32.Sum32()
+	// hash is created for every call because sessions are added and deleted concurrently
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(s))
+	return hash.Sum32()
 }
 
 // Manager 是用來控制 Gateway 的facade
 type Manager struct {
+	opts          options
 	hub           prelude.Huber
 	hostname      string
 	ctx           context.Context
 	activeState   int32
 	mutex         sync.Mutex
 	buckets       []*Bucket
+	roomMutex     sync.Mutex
+	rooms         sync.Map
 	status        *Status
 	eventChan     chan cloudevents.Event
 	eventStopChan chan bool
+	stopChan      chan struct{}
+	stopOnce      sync.Once
 }
 
 // NewManager 用來產生一個新的 Manager 用來控制 Gateway
-func NewManager(hub prelude.Huber) *Manager {
+func NewManager(hub prelude.Huber, opts ...Option) *Manager {
 	hostname, _ := os.Hostname()
-
-	bucketCount, _ := config.Int32("websocket.bucket_count", 128)
-	eventCount, _ := config.Int32("websocket.bucket_event_count", 128)
+	o := newOptions(opts...)
+	if o.nodeID == "" {
+		o.nodeID = uuid.NewString()
+	}
 
 	m := &Manager{
+		opts:          o,
 		hub:           hub,
 		hostname:      hostname,
 		ctx:           context.Background(),
-		buckets:       make([]*Bucket, bucketCount),
+		buckets:       make([]*Bucket, o.bucketCount),
 		status:        &Status{},
-		eventChan:     make(chan cloudevents.Event, eventCount),
+		eventChan:     make(chan cloudevents.Event, o.hubQueueSize),
 		eventStopChan: make(chan bool, 1),
+		stopChan:      make(chan struct{}),
 		mutex:         sync.Mutex{},
 	}
 
@@ -69,6 +79,11 @@ func (m *Manager) Context() context.Context {
 	return m.ctx
 }
 
+// NodeID returns the id of gateway node
+func (m *Manager) NodeID() string {
+	return m.opts.nodeID
+}
+
 // Status 可以知道目前 Gateway 的狀態，例如連線人數等
 func (m *Manager) Status() *Status {
 	return m.status
@@ -96,36 +111,19 @@ func (m *Manager) DeleteSession(session *WSSession) error {
 	return nil
 }
 
-// RouteInfo 代表 session 最後看見的時間
-type RouteInfo struct {
-	SessionID   string
-	GatewayAddr string
-	LastSeenAt  time.Time `json:"lastSeenAt"`
-}
-
-// UpdateRouteInfo 用來更新目前 session 所在的 gateway 主機和最後一次收到 pong 的時間 (lastSeenAt)
+// UpdateRouteInfo 用來更新目前 session 所在的 gateway 主機和最後一次收到 pong 的時間 (lastSeenAt).  The session is registered
+// or refreshed in the presence of router.
 func (m *Manager) UpdateRouteInfo(session *WSSession) error {
-	event := cloudevents.NewEvent()
-	event.SetID(uuid.NewString())
-	event.SetSource(m.hostname)
-	event.SetType("events.routes_info")
-
-	body := RouteInfo{
-		SessionID:   session.ID(),
-		LastSeenAt:  session.LastSeenAt(),
-		GatewayAddr: m.hostname,
+	info := prelude.SessionInfo{
+		SessionID:  session.ID(),
+		NodeID:     m.NodeID(),
+		LastSeenAt: session.LastSeenAt(),
 	}
-
-	b, err := json.Marshal(&body)
-	if err != nil {
-		return err
+	if identity := session.Identity(); identity != nil {
+		info.UserID = identity.UserID
 	}
 
-	err = event.SetData(cloudevents.ApplicationJSON, b)
-	if err != nil {
-		return err
-	}
-	return m.AddEventToHub(event)
+	return m.hub.Router().Presence().Register(info)
 }
 
 // Push 用來推播訊息到 client
@@ -138,32 +136,69 @@ func (m *Manager) Push(sessionID string, event cloudevents.Event) error {
 	return b.push(sessionID, event)
 }
 
-// AddEventToHub 把 event 送到 hub 讓 consumer 可以讀取 device 傳送過來的 event
+// Broadcast pushes the event to all sessions of the gateway.  Each bucket is handled concurrently.
+func (m *Manager) Broadcast(event cloudevents.Event) error {
+	if !m.IsActive() {
+		log.Debug("websocket: manager can't accept more events because server is shutting down or closed.")
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(m.buckets))
+	for _, bucket := range m.buckets {
+		go func(b *Bucket) {
+			defer wg.Done()
+			b.pushAll(event)
+		}(bucket)
+	}
+	wg.Wait()
+	return nil
+}
+
+// AddEventToHub 把 event 送到 hub 讓 consumer 可以讀取 device 傳送過來的 event.  It returns ErrQueueFull if the event is dropped
+// by the backpressure policy.
 func (m *Manager) AddEventToHub(event cloudevents.Event) error {
 	if !m.IsActive() {
 		log.Debug("websocket: manager can't accept more events because server is shutting down or closed.")
 		return nil
 	}
 
-	select {
-	case m.eventChan <- event:
-	default:
+	enqueued, dropped := enqueueEvent(m.eventChan, event, m.opts.backpressurePolicy, m.opts.backpressureTimeout)
+	if dropped > 0 {
+		m.status.addDroppedHubEvents(dropped)
+		log.Str("action", event.Type()).Str("policy", m.opts.backpressurePolicy.String()).Debugf("websocket: %d events were dropped from hub queue", dropped)
 	}
 
+	if !enqueued {
+		return ErrQueueFull
+	}
 	return nil
 }
 
 func (m *Manager) eventLoop() {
 	for {
-		event := <-m.eventChan
-		err := m.hub.Publish(event.Type(), event)
-		if err != nil {
-			log.Str("action", event.Type()).Error("websocket: fail to publish event to hub")
+		select {
+		case event := <-m.eventChan:
+			m.publishEvent(event)
+		case <-m.stopChan:
+			// publish the remaining events before stopping
+			for {
+				select {
+				case event := <-m.eventChan:
+					m.publishEvent(event)
+				default:
+					close(m.eventStopChan)
+					return
+				}
+			}
 		}
+	}
+}
 
-		if !m.IsActive() && len(m.eventChan) == 0 {
-			m.eventStopChan <- true
-		}
+func (m *Manager) publishEvent(event cloudevents.Event) {
+	err := m.hub.Publish(event.Type(), event)
+	if err != nil {
+		log.Err(err).Str("action", event.Type()).Error("websocket: fail to publish event to hub")
 	}
 }
 
@@ -185,27 +220,111 @@ func (m *Manager) SetActive(val bool) {
 func (m *Manager) Start() error {
 	m.SetActive(true)
 	go m.eventLoop()
+
+	if m.slowConsumerEnabled() {
+		go m.evictionLoop()
+	}
+
+	router := m.hub.Router()
+	router.AddRoute(prelude.BroadcastTopic, func(c *prelude.Context) error {
+		return m.Broadcast(c.Event)
+	}, prelude.WithDelivery(prelude.BroadcastDelivery), prelude.WithoutGlobalMiddleware())
+
+	// the gateway subscribes its node topic once instead of one topic per session
+	router.AddRoute(prelude.NodeTopic(m.NodeID(), ":sessionID"), m.handleSessionEvent, prelude.WithDelivery(prelude.BroadcastDelivery),
+		prelude.WithoutGlobalMiddleware())
 	return nil
 }
 
-// Shutdown represent graceful shutdown manager
+// handleSessionEvent handles the events which are published to the node topic of sessions
+func (m *Manager) handleSessionEvent(c *prelude.Context) error {
+	sessionID := c.Param("sessionID")
+
+	switch c.Event.Type() {
+	case "metadata.add", "room.join", "room.leave":
+		session := m.bucketBySessionID(sessionID).session(sessionID)
+		if session == nil {
+			log.Str("session_id", sessionID).Debugf("websocket: session_id: %s doesn't exist", sessionID)
+			return nil
+		}
+		return session.handleCommand(c)
+	}
+
+	return m.Push(sessionID, c.Event)
+}
+
+// DrainNotice is the data of draining event which is sent to every session on shutdown
+type DrainNotice struct {
+	Reason string `json:"reason"`
+	// ReconnectAfterMS hints the client to wait a random delay before reconnecting
+	ReconnectAfterMS int64 `json:"reconnect_after_ms"`
+}
+
+// drain sends the draining event and close frame to all sessions.  Sessions are drained evenly over the drain window
+// and the remaining sessions are drained at once when the context is done.
+func (m *Manager) drain(ctx context.Context) {
+	sessions := []*WSSession{}
+	for _, bucket := range m.buckets {
+		sessions = append(sessions, bucket.allSessions()...)
+	}
+
+	if len(sessions) == 0 {
+		return
+	}
+
+	log.Infof("websocket: draining %d sessions in %s", len(sessions), m.opts.drainWindow)
+	interval := m.opts.drainWindow / time.Duration(len(sessions))
+
+	for _, session := range sessions {
+		notice := DrainNotice{
+			Reason: "server is shutting down",
+		}
+		if m.opts.drainWindow > 0 {
+			notice.ReconnectAfterMS = rand.Int63n(m.opts.drainWindow.Milliseconds() + 1) // nolint:gosec
+		}
+
+		event := cloudevents.NewEvent()
+		event.SetID(uuid.NewString())
+		event.SetSource(m.hostname)
+		event.SetTime(time.Now().UTC())
+		event.SetType(m.opts.drainEventType)
+		err := event.SetData(cloudevents.ApplicationJSON, notice)
+		if err != nil {
+			log.Err(err).Error("websocket: draining event is invalid")
+			return
+		}
+
+		session.drain(event)
+
+		if interval > 0 {
+			timer := time.NewTimer(interval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				interval = 0
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+// Shutdown represent graceful shutdown manager.  It drains all sessions and waits until all events are published to hub or the context is done.
 func (m *Manager) Shutdown(ctx context.Context) error {
 	m.SetActive(false)
 	m.ctx = ctx
 
-	stop := make(chan bool)
-	go func() {
-		// wait to process all events
-		<-m.eventStopChan
-		close(m.eventChan)
-		stop <- true
-	}()
+	m.drain(ctx)
+
+	m.stopOnce.Do(func() {
+		close(m.stopChan)
+	})
 
+	// wait to process all events
 	select {
 	case <-ctx.Done():
 		log.Err(ctx.Err()).Error("websocket: manager shutdown timeout")
-		break
-	case <-stop:
+		return ctx.Err()
+	case <-m.eventStopChan:
 		log.Info("websocket: manager was shutdown gracefully")
 	}
 
@@ -0,0 +1,376 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/nite-coder/prelude"
+	"github.com/nite-coder/prelude/hub/channel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBroadcast(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+	manager := NewManager(hub)
+	err := manager.Start()
+	require.NoError(t, err)
+
+	router.AddRoute("maintenance", func(c *prelude.Context) error {
+		return c.Broadcast("server.maintenance", "in 5 minutes")
+	})
+
+	sessions := []*WSSession{}
+	for i := 0; i < 10; i++ {
+		session := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+		err := manager.AddSession(session)
+		require.NoError(t, err)
+		sessions = append(sessions, session)
+	}
+
+	event := cloudevents.NewEvent()
+	event.SetID(uuid.NewString())
+	event.SetSource("admin")
+	event.SetType("maintenance")
+	err = hub.Publish("maintenance", event)
+	require.NoError(t, err)
+
+	for _, session := range sessions {
+		select {
+		case msg := <-session.outChan:
+			received := cloudevents.NewEvent()
+			err := json.Unmarshal(msg.MsgData, &received)
+			require.NoError(t, err)
+			assert.Equal(t, "server.maintenance", received.Type())
+		case <-time.After(time.Second):
+			t.Fatalf("session %s didn't receive broadcast event", session.ID())
+		}
+	}
+}
+
+func TestNewManagerWithOptions(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+
+	m1 := NewManager(hub, WithBucketCount(4), WithSessionQueueSize(1, 2, 3))
+	m2 := NewManager(hub)
+
+	assert.Len(t, m1.buckets, 4)
+	assert.Len(t, m2.buckets, 128)
+
+	session := NewWSSession(uuid.NewString(), "127.0.0.1", nil, m1)
+	assert.Equal(t, 1, cap(session.inChan))
+	assert.Equal(t, 2, cap(session.outChan))
+	assert.Equal(t, 3, cap(session.eventChan))
+}
+
+func TestInvalidOptions(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+
+	m := NewManager(hub,
+		WithBucketCount(0),
+		WithHubQueueSize(-1),
+		WithSessionQueueSize(-1, 0, -1),
+		WithPingPeriod(0),
+		WithSessionUpdateInterval(-time.Second),
+	)
+	assert.Len(t, m.buckets, 128)
+	assert.Equal(t, 128, cap(m.eventChan))
+	assert.Equal(t, 20*time.Second, m.opts.pingPeriod)
+	assert.Equal(t, 60*time.Second, m.opts.sessionUpdateInterval)
+
+	session := NewWSSession(uuid.NewString(), "127.0.0.1", nil, m)
+	assert.Equal(t, 128, cap(session.inChan))
+	assert.Equal(t, 128, cap(session.outChan))
+	assert.Equal(t, 128, cap(session.eventChan))
+	assert.NotNil(t, m.bucketBySessionID(session.ID()))
+
+	// ping period must be less than pong wait
+	o := newOptions(WithPongWait(10*time.Second), WithPingPeriod(time.Minute))
+	assert.Equal(t, 9*time.Second, o.pingPeriod)
+}
+
+func TestGatewaySetAuthenticator(t *testing.T) {
+	authenticator := AuthenticatorFunc(func(r *http.Request) (*Identity, error) {
+		return &Identity{UserID: "user1"}, nil
+	})
+
+	gateway := NewGateway(WithBucketCount(4))
+	gateway.SetAuthenticator(authenticator)
+
+	o := newOptions(gateway.opts...)
+	assert.Equal(t, 4, o.bucketCount)
+	require.NotNil(t, o.authenticator)
+	identity, err := o.authenticator.Authenticate(httptest.NewRequest(http.MethodGet, "/", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", identity.UserID)
+}
+
+func TestGatewayShutdownBeforeListen(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	prelude.NewRouter("prelude", hub)
+	gateway := NewGateway()
+
+	err := gateway.Shutdown(context.Background())
+	require.NoError(t, err)
+
+	// the gateway doesn't serve after it was shut down
+	done := make(chan error, 1)
+	go func() {
+		done <- gateway.ListenAndServe("127.0.0.1:0", hub)
+	}()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("ListenAndServe didn't return after Shutdown")
+	}
+	assert.Nil(t, gateway.manager)
+}
+
+func TestOriginChecker(t *testing.T) {
+	checkOrigin := newOptions(WithAllowedOrigins("https://example.com")).checkOrigin
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.True(t, checkOrigin(r))
+
+	r.Header.Set("Origin", "https://example.com")
+	assert.True(t, checkOrigin(r))
+
+	r.Header.Set("Origin", "https://evil.com")
+	assert.False(t, checkOrigin(r))
+
+	assert.True(t, newOptions().checkOrigin(r))
+}
+
+func TestManagerShutdown(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+	manager := NewManager(hub)
+	err := manager.Start()
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	router.AddRoute("hello", func(c *prelude.Context) error {
+		wg.Done()
+		return nil
+	})
+
+	event := cloudevents.NewEvent()
+	event.SetID(uuid.NewString())
+	event.SetSource("client")
+	event.SetType("hello")
+	err = manager.AddEventToHub(event)
+	require.NoError(t, err)
+
+	err = manager.Shutdown(context.Background())
+	require.NoError(t, err)
+	assert.False(t, manager.IsActive())
+	wg.Wait()
+
+	// shutdown can be called more than once
+	err = manager.Shutdown(context.Background())
+	require.NoError(t, err)
+}
+
+func TestManagerDrain(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	_ = prelude.NewRouter("prelude", hub)
+	manager := NewManager(hub, WithDrain(30*time.Millisecond, ""))
+	err := manager.Start()
+	require.NoError(t, err)
+
+	sessions := []*WSSession{}
+	for i := 0; i < 3; i++ {
+		session := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+		err := manager.AddSession(session)
+		require.NoError(t, err)
+		sessions = append(sessions, session)
+	}
+
+	err = manager.Shutdown(context.Background())
+	require.NoError(t, err)
+
+	for _, session := range sessions {
+		msg := <-session.outChan
+		received := cloudevents.NewEvent()
+		err := json.Unmarshal(msg.MsgData, &received)
+		require.NoError(t, err)
+		assert.Equal(t, "server.draining", received.Type())
+
+		notice := DrainNotice{}
+		err = received.DataAs(&notice)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, notice.ReconnectAfterMS, int64(30))
+
+		msg = <-session.outChan
+		assert.Equal(t, websocket.CloseMessage, msg.MsgType)
+	}
+}
+
+func TestNodeTopic(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+	manager := NewManager(hub, WithNodeID("node1"))
+	err := manager.Start()
+	require.NoError(t, err)
+
+	session := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+	require.NoError(t, manager.AddSession(session))
+	require.NoError(t, manager.UpdateRouteInfo(session))
+
+	router.AddRoute("notify", func(c *prelude.Context) error {
+		return c.Write("notice", cloudevents.ApplicationJSON, []byte(`"hello"`), session.ID())
+	})
+
+	router.AddRoute("login", func(c *prelude.Context) error {
+		return c.Set("token", "atoken")
+	})
+
+	event := cloudevents.NewEvent()
+	event.SetID(uuid.NewString())
+	event.SetSource("admin")
+	event.SetType("notify")
+	err = hub.Publish("notify", event)
+	require.NoError(t, err)
+
+	select {
+	case received := <-session.eventChan:
+		assert.Equal(t, "notice", received.Type())
+	case <-time.After(time.Second):
+		t.Fatal("session didn't receive event from node topic")
+	}
+
+	// the node of sender session is taken from the event
+	event.SetType("login")
+	event.SetExtension(prelude.SessionID, session.ID())
+	event.SetExtension(prelude.NodeID, manager.NodeID())
+	err = hub.Publish("login", event)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return session.Metadata()["token"] == "atoken"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestWriteToUser(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+	manager := NewManager(hub)
+	err := manager.Start()
+	require.NoError(t, err)
+
+	newUserSession := func(userID string) *WSSession {
+		session := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+		session.SetIdentity(&Identity{UserID: userID})
+		require.NoError(t, manager.AddSession(session))
+		require.NoError(t, manager.UpdateRouteInfo(session))
+		return session
+	}
+
+	phone := newUserSession("user1")
+	laptop := newUserSession("user1")
+	other := newUserSession("user2")
+
+	router.AddRoute("sync", func(c *prelude.Context) error {
+		return c.WriteToUser(c.UserID(), "synced", "hello", prelude.ExcludeSender())
+	})
+
+	event := cloudevents.NewEvent()
+	event.SetID(uuid.NewString())
+	event.SetSource("client")
+	event.SetType("sync")
+	event.SetExtension(prelude.SessionID, phone.ID())
+	event.SetExtension(prelude.UserID, "user1")
+	err = hub.Publish("sync", event)
+	require.NoError(t, err)
+
+	select {
+	case received := <-laptop.eventChan:
+		assert.Equal(t, "synced", received.Type())
+	case <-time.After(time.Second):
+		t.Fatal("the other session of user didn't receive event")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, phone.eventChan, 0)
+	assert.Len(t, other.eventChan, 0)
+}
+
+func TestInternalRoutesSkipGlobalMiddleware(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+
+	// the authentication middleware rejects the events without user
+	errUnauthorized := prelude.NewError("unauthorized", "user is required")
+	router.Use(func(c *prelude.Context) error {
+		if c.UserID() == "" {
+			return errUnauthorized
+		}
+		return c.Next()
+	})
+
+	manager := NewManager(hub)
+	err := manager.Start()
+	require.NoError(t, err)
+
+	session := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+	session.SetIdentity(&Identity{UserID: "user1"})
+	session.SetActive(true)
+	require.NoError(t, manager.AddSession(session))
+	require.NoError(t, manager.UpdateRouteInfo(session))
+	require.NoError(t, manager.JoinRoom("lobby", session))
+
+	router.AddRoute("sync", func(c *prelude.Context) error {
+		err := c.JSON("synced", "hello")
+		if err != nil {
+			return err
+		}
+		err = c.WriteToRoom("lobby", "room.synced", "hello")
+		if err != nil {
+			return err
+		}
+		return c.Broadcast("broadcast.synced", "hello")
+	})
+
+	event := cloudevents.NewEvent()
+	event.SetID(uuid.NewString())
+	event.SetSource("client")
+	event.SetType("sync")
+	event.SetExtension(prelude.SessionID, session.ID())
+	event.SetExtension(prelude.UserID, "user1")
+	err = hub.Publish("sync", event)
+	require.NoError(t, err)
+
+	// the events which are sent by services don't have user, but they are still pushed to the session
+	received := []string{}
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-session.eventChan:
+			received = append(received, e.Type())
+		case <-time.After(time.Second):
+			t.Fatalf("session only received %v", received)
+		}
+	}
+	assert.ElementsMatch(t, []string{"synced", "room.synced"}, received)
+
+	// the broadcast event is encoded once and pushed as message
+	select {
+	case msg := <-session.outChan:
+		e, err := session.codec.decode(msg)
+		require.NoError(t, err)
+		assert.Equal(t, "broadcast.synced", e.Type())
+	case <-time.After(time.Second):
+		t.Fatal("session didn't receive broadcast event")
+	}
+}
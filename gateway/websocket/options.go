@@ -0,0 +1,326 @@
+package websocket
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nite-coder/blackbear/pkg/config"
+	"github.com/nite-coder/blackbear/pkg/log"
+)
+
+const defaultSessionUpdateInterval = 60 * time.Second
+
+// Option configures the Gateway
+type Option func(*options)
+
+type options struct {
+	nodeID                string
+	readBufferSize        int
+	writeBufferSize       int
+	bucketCount           int
+	hubQueueSize          int
+	sessionInboundCount   int
+	sessionOutboundCount  int
+	sessionEventCount     int
+	pongWait              time.Duration
+	pingPeriod            time.Duration
+	maxMessageSize        int64
+	sessionUpdateRoute    bool
+	sessionUpdateInterval time.Duration
+	drainWindow           time.Duration
+	drainEventType        string
+	backpressurePolicy    BackpressurePolicy
+	backpressureTimeout   time.Duration
+	slowQueueDepth        int
+	slowWriteLatency      time.Duration
+	slowPeriod            time.Duration
+	routeCheck            bool
+	allowedOrigins        []string
+	checkOrigin           func(r *http.Request) bool
+	authenticator         Authenticator
+}
+
+func defaultOptions() options {
+	return options{
+		readBufferSize:        4096,
+		writeBufferSize:       4096,
+		bucketCount:           128,
+		hubQueueSize:          128,
+		sessionInboundCount:   128,
+		sessionOutboundCount:  128,
+		sessionEventCount:     128,
+		pingPeriod:            20 * time.Second,
+		sessionUpdateInterval: defaultSessionUpdateInterval,
+		drainEventType:        "server.draining",
+		backpressureTimeout:   time.Second,
+		allowedOrigins:        []string{"*"},
+	}
+}
+
+func newOptions(opts ...Option) options {
+	defaults := defaultOptions()
+	o := defaults
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.sanitize(defaults)
+
+	if o.checkOrigin == nil {
+		o.checkOrigin = originChecker(o.allowedOrigins)
+	}
+
+	return o
+}
+
+// sanitize replaces the invalid values with the default values, so the gateway doesn't panic on them, e.g. zero bucket count
+func (o *options) sanitize(defaults options) {
+	positiveInt := func(name string, value *int, defaultValue int) {
+		if *value <= 0 {
+			log.Str("option", name).Str("value", strconv.Itoa(*value)).Warn("websocket: option is invalid and the default value is used")
+			*value = defaultValue
+		}
+	}
+	positiveDuration := func(name string, value *time.Duration, defaultValue time.Duration) {
+		if *value <= 0 {
+			log.Str("option", name).Str("value", value.String()).Warn("websocket: option is invalid and the default value is used")
+			*value = defaultValue
+		}
+	}
+
+	positiveInt("read_buffer_size", &o.readBufferSize, defaults.readBufferSize)
+	positiveInt("write_buffer_size", &o.writeBufferSize, defaults.writeBufferSize)
+	positiveInt("bucket_count", &o.bucketCount, defaults.bucketCount)
+	positiveInt("bucket_event_count", &o.hubQueueSize, defaults.hubQueueSize)
+	positiveInt("session_inbound_count", &o.sessionInboundCount, defaults.sessionInboundCount)
+	positiveInt("session_outbound_count", &o.sessionOutboundCount, defaults.sessionOutboundCount)
+	positiveInt("session_event_count", &o.sessionEventCount, defaults.sessionEventCount)
+	positiveDuration("ping_period", &o.pingPeriod, defaults.pingPeriod)
+	positiveDuration("session_update_interval", &o.sessionUpdateInterval, defaults.sessionUpdateInterval)
+	positiveDuration("backpressure_timeout", &o.backpressureTimeout, defaults.backpressureTimeout)
+
+	// zero disables these options
+	if o.pongWait < 0 {
+		o.pongWait = 0
+	}
+	if o.pongWait > 0 && o.pingPeriod >= o.pongWait {
+		log.Str("ping_period", o.pingPeriod.String()).Str("pong_wait", o.pongWait.String()).Warn("websocket: ping period must be less than pong wait")
+		o.pingPeriod = o.pongWait * 9 / 10
+	}
+	if o.maxMessageSize < 0 {
+		o.maxMessageSize = 0
+	}
+	if o.drainWindow < 0 {
+		o.drainWindow = 0
+	}
+	if o.slowQueueDepth < 0 {
+		o.slowQueueDepth = 0
+	}
+	if o.slowWriteLatency < 0 {
+		o.slowWriteLatency = 0
+	}
+	if o.slowPeriod < 0 {
+		o.slowPeriod = 0
+	}
+}
+
+// originChecker returns a function which checks Origin header of upgrade request against allowed origins.  "*" allows all origins.
+func originChecker(allowedOrigins []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+
+		for _, allowedOrigin := range allowedOrigins {
+			if allowedOrigin == "*" || strings.EqualFold(allowedOrigin, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// WithNodeID sets the id of gateway node which is used in node topic "gw.<nodeID>.*".  It must be unique in the cluster and
+// a random uuid is used by default.
+func WithNodeID(nodeID string) Option {
+	return func(o *options) {
+		o.nodeID = nodeID
+	}
+}
+
+// WithBufferSize sets the read and write buffer size of websocket connection in bytes
+func WithBufferSize(read, write int) Option {
+	return func(o *options) {
+		o.readBufferSize = read
+		o.writeBufferSize = write
+	}
+}
+
+// WithBucketCount sets the number of buckets which sessions are sharded into
+func WithBucketCount(count int) Option {
+	return func(o *options) {
+		o.bucketCount = count
+	}
+}
+
+// WithHubQueueSize sets the capacity of the queue of events which are waiting to be published to hub
+func WithHubQueueSize(size int) Option {
+	return func(o *options) {
+		o.hubQueueSize = size
+	}
+}
+
+// WithSessionQueueSize sets the capacity of inbound message, outbound message and event queues of each session
+func WithSessionQueueSize(inbound, outbound, event int) Option {
+	return func(o *options) {
+		o.sessionInboundCount = inbound
+		o.sessionOutboundCount = outbound
+		o.sessionEventCount = event
+	}
+}
+
+// WithPongWait sets the time allowed to read the next pong message from client.  Zero means no deadline.
+func WithPongWait(d time.Duration) Option {
+	return func(o *options) {
+		o.pongWait = d
+	}
+}
+
+// WithPingPeriod sets the period of ping messages which are sent to client.  It must be less than pong wait.
+func WithPingPeriod(d time.Duration) Option {
+	return func(o *options) {
+		o.pingPeriod = d
+	}
+}
+
+// WithMaxMessageSize sets the maximum size in bytes of message which is read from client.  Zero means no limit.
+func WithMaxMessageSize(size int64) Option {
+	return func(o *options) {
+		o.maxMessageSize = size
+	}
+}
+
+// WithSessionUpdateRoute enables refreshing each session in the presence periodically.  It must be enabled if the presence expires sessions.
+func WithSessionUpdateRoute(enabled bool) Option {
+	return func(o *options) {
+		o.sessionUpdateRoute = enabled
+	}
+}
+
+// WithSessionUpdateInterval sets the interval of refreshing sessions in the presence.  It must be less than the ttl of presence.
+func WithSessionUpdateInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.sessionUpdateInterval = d
+	}
+}
+
+// WithDrain sets the drain window and the type of event which is sent to every session before the close frame on shutdown.
+// Sessions are closed evenly over the window, so clients don't reconnect to other gateways at the same time.
+func WithDrain(window time.Duration, eventType string) Option {
+	return func(o *options) {
+		o.drainWindow = window
+		if eventType != "" {
+			o.drainEventType = eventType
+		}
+	}
+}
+
+// WithBackpressure sets the policy which is applied when the outbound queues of session or the hub queue are full.  Timeout is only
+// used by Block policy.  With Disconnect policy, the session is closed when its outbound queues are full or it sends events faster
+// than they are published to hub.
+func WithBackpressure(policy BackpressurePolicy, timeout time.Duration) Option {
+	return func(o *options) {
+		o.backpressurePolicy = policy
+		o.backpressureTimeout = timeout
+	}
+}
+
+// WithSlowConsumerEviction closes the sessions whose outbound queue depth or write latency stay above the thresholds for the period.
+// Zero threshold disables the check.  A session.evicted event is published to hub when a session is evicted.
+func WithSlowConsumerEviction(queueDepth int, writeLatency time.Duration, period time.Duration) Option {
+	return func(o *options) {
+		o.slowQueueDepth = queueDepth
+		o.slowWriteLatency = writeLatency
+		o.slowPeriod = period
+	}
+}
+
+// WithRouteCheck enables checking the route of inbound event in the router of gateway before it is published to hub.  The not-found
+// handler of router handles the events which don't match any route, e.g. route.not_found event is sent back to the client.  It is
+// disabled by default and it must only be enabled if all handlers are added in the router of gateway process, otherwise the events
+// which are handled by services in other processes are never published to hub.
+func WithRouteCheck(enabled bool) Option {
+	return func(o *options) {
+		o.routeCheck = enabled
+	}
+}
+
+// WithAllowedOrigins sets the origins which are allowed to connect.  "*" allows all origins and it is the default.
+func WithAllowedOrigins(origins ...string) Option {
+	return func(o *options) {
+		o.allowedOrigins = origins
+	}
+}
+
+// WithCheckOrigin sets the function which decides whether the upgrade request is allowed by its Origin header.
+// It takes precedence over WithAllowedOrigins.
+func WithCheckOrigin(checkOrigin func(r *http.Request) bool) Option {
+	return func(o *options) {
+		o.checkOrigin = checkOrigin
+	}
+}
+
+// WithAuthenticator sets the authenticator which authenticates every websocket upgrade request
+func WithAuthenticator(authenticator Authenticator) Option {
+	return func(o *options) {
+		o.authenticator = authenticator
+	}
+}
+
+// WithConfig reads the settings from config file under the prefix, e.g. "websocket".  Options after it override the config file.
+func WithConfig(prefix string) Option {
+	return func(o *options) {
+		o.nodeID, _ = config.String(prefix+".node_id", o.nodeID)
+		readBufferSize, _ := config.Int32(prefix+".read_buffer_size", int32(o.readBufferSize))
+		writeBufferSize, _ := config.Int32(prefix+".write_buffer_size", int32(o.writeBufferSize))
+		bucketCount, _ := config.Int32(prefix+".bucket_count", int32(o.bucketCount))
+		hubQueueSize, _ := config.Int32(prefix+".bucket_event_count", int32(o.hubQueueSize))
+		inboundCount, _ := config.Int32(prefix+".session_inbound_count", int32(o.sessionInboundCount))
+		outboundCount, _ := config.Int32(prefix+".session_outbound_count", int32(o.sessionOutboundCount))
+		eventCount, _ := config.Int32(prefix+".session_event_count", int32(o.sessionEventCount))
+
+		o.readBufferSize = int(readBufferSize)
+		o.writeBufferSize = int(writeBufferSize)
+		o.bucketCount = int(bucketCount)
+		o.hubQueueSize = int(hubQueueSize)
+		o.sessionInboundCount = int(inboundCount)
+		o.sessionOutboundCount = int(outboundCount)
+		o.sessionEventCount = int(eventCount)
+		o.pongWait, _ = config.Duration(prefix+".pong_wait", o.pongWait)
+		o.pingPeriod, _ = config.Duration(prefix+".ping_period", o.pingPeriod)
+		o.maxMessageSize, _ = config.Int64(prefix+".max_message_size_byte", o.maxMessageSize)
+		o.sessionUpdateRoute, _ = config.Bool(prefix+".session_update_route", o.sessionUpdateRoute)
+		o.sessionUpdateInterval, _ = config.Duration(prefix+".session_update_interval", o.sessionUpdateInterval)
+		o.drainWindow, _ = config.Duration(prefix+".drain_window", o.drainWindow)
+		o.drainEventType, _ = config.String(prefix+".drain_event_type", o.drainEventType)
+		o.backpressureTimeout, _ = config.Duration(prefix+".backpressure_timeout", o.backpressureTimeout)
+
+		slowQueueDepth, _ := config.Int32(prefix+".slow_consumer_queue_depth", int32(o.slowQueueDepth))
+		o.slowQueueDepth = int(slowQueueDepth)
+		o.slowWriteLatency, _ = config.Duration(prefix+".slow_consumer_write_latency", o.slowWriteLatency)
+		o.slowPeriod, _ = config.Duration(prefix+".slow_consumer_period", o.slowPeriod)
+		o.routeCheck, _ = config.Bool(prefix+".route_check", o.routeCheck)
+
+		policy, _ := config.String(prefix+".backpressure_policy", o.backpressurePolicy.String())
+		backpressurePolicy, err := ParseBackpressurePolicy(policy)
+		if err != nil {
+			log.Err(err).Str("backpressure_policy", policy).Str("default", o.backpressurePolicy.String()).
+				Error("websocket: backpressure policy is unknown and the default policy is used")
+			return
+		}
+		o.backpressurePolicy = backpressurePolicy
+	}
+}
@@ -0,0 +1,111 @@
+package websocket
+
+import (
+	"fmt"
+	"sync"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/nite-coder/blackbear/pkg/log"
+	"github.com/nite-coder/prelude"
+)
+
+// Room is a group of sessions on this gateway which receive the same events
+type Room struct {
+	id       string
+	sessions sync.Map
+}
+
+func newRoom(id string) *Room {
+	return &Room{
+		id: id,
+	}
+}
+
+func (r *Room) addSession(session *WSSession) {
+	r.sessions.Store(session.ID(), session)
+	log.Str("session_id", session.ID()).Str("room_id", r.id).Debugf("websocket: session id %s joined room id %s", session.ID(), r.id)
+}
+
+func (r *Room) deleteSession(session *WSSession) {
+	r.sessions.Delete(session.ID())
+	log.Str("session_id", session.ID()).Str("room_id", r.id).Debugf("websocket: session id %s left room id %s", session.ID(), r.id)
+}
+
+func (r *Room) isEmpty() bool {
+	empty := true
+	r.sessions.Range(func(_, _ interface{}) bool {
+		empty = false
+		return false
+	})
+	return empty
+}
+
+func (r *Room) pushAll(event cloudevents.Event) {
+	r.sessions.Range(func(key, value interface{}) bool {
+		session, ok := value.(*WSSession)
+		if ok {
+			_ = session.SendEvent(event)
+		}
+		return true
+	})
+}
+
+func roomTopic(roomID string) string {
+	return fmt.Sprintf("room.%s", roomID)
+}
+
+// JoinRoom adds the session to the room.  The gateway subscribes the room topic when the first session joins the room.
+func (m *Manager) JoinRoom(roomID string, session *WSSession) error {
+	err := prelude.ValidateRoomID(roomID)
+	if err != nil {
+		return err
+	}
+
+	m.roomMutex.Lock()
+	defer m.roomMutex.Unlock()
+
+	var room *Room
+	val, found := m.rooms.Load(roomID)
+	if found {
+		room, _ = val.(*Room)
+	}
+
+	if room == nil {
+		room = newRoom(roomID)
+		m.rooms.Store(roomID, room)
+		m.hub.Router().AddRoute(roomTopic(roomID), func(c *prelude.Context) error {
+			room.pushAll(c.Event)
+			return nil
+		}, prelude.WithDelivery(prelude.BroadcastDelivery), prelude.WithoutGlobalMiddleware())
+	}
+
+	room.addSession(session)
+	session.rooms.Store(roomID, room)
+	return nil
+}
+
+// LeaveRoom removes the session from the room.  The gateway unsubscribes the room topic when the last session leaves the room.
+func (m *Manager) LeaveRoom(roomID string, session *WSSession) error {
+	m.roomMutex.Lock()
+	defer m.roomMutex.Unlock()
+
+	val, found := m.rooms.Load(roomID)
+	if !found {
+		return nil
+	}
+
+	room, ok := val.(*Room)
+	if !ok {
+		return nil
+	}
+
+	room.deleteSession(session)
+	session.rooms.Delete(roomID)
+
+	if room.isEmpty() {
+		m.rooms.Delete(roomID)
+		m.hub.Router().RemoveRoute(roomTopic(roomID))
+		log.Str("room_id", roomID).Debugf("websocket: room id %s was removed", roomID)
+	}
+	return nil
+}
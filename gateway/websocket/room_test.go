@@ -0,0 +1,79 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/google/uuid"
+	"github.com/nite-coder/prelude"
+	"github.com/nite-coder/prelude/hub/channel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoom(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+	manager := NewManager(hub)
+
+	router.AddRoute("chat", func(c *prelude.Context) error {
+		return c.WriteToRoom("lobby", "chat.message", "hello")
+	})
+
+	member := NewWSSession("member", "127.0.0.1", nil, manager)
+	stranger := NewWSSession("stranger", "127.0.0.1", nil, manager)
+
+	err := manager.JoinRoom("lobby", member)
+	require.NoError(t, err)
+
+	event := cloudevents.NewEvent()
+	event.SetID(uuid.NewString())
+	event.SetSource("client")
+	event.SetType("chat")
+	err = hub.Publish("chat", event)
+	require.NoError(t, err)
+
+	select {
+	case received := <-member.eventChan:
+		assert.Equal(t, "chat.message", received.Type())
+		assert.Equal(t, "\"hello\"", string(received.Data()))
+	case <-time.After(time.Second):
+		t.Fatal("member didn't receive room event")
+	}
+	assert.Len(t, stranger.eventChan, 0)
+
+	err = manager.LeaveRoom("lobby", member)
+	require.NoError(t, err)
+
+	// the room is removed when the last session leaves
+	_, found := manager.rooms.Load("lobby")
+	assert.False(t, found)
+	assert.Nil(t, router.Find("room.lobby"))
+
+	err = hub.Publish("chat", event)
+	require.NoError(t, err)
+
+	select {
+	case <-member.eventChan:
+		t.Fatal("member received room event after leaving the room")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestJoinInvalidRoom(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+	manager := NewManager(hub)
+	session := NewWSSession("member", "127.0.0.1", nil, manager)
+
+	for _, roomID := range []string{"", "lobby.vip", "*", "lobby>", ">", ":id"} {
+		err := manager.JoinRoom(roomID, session)
+		assert.ErrorIs(t, err, ErrInvalidRoomID, roomID)
+	}
+	assert.Nil(t, router.Find("room.lobby.vip"))
+	assert.Nil(t, router.Find("room.any"))
+
+	err := manager.JoinRoom("lobby_vip-1", session)
+	assert.NoError(t, err)
+}
@@ -3,7 +3,6 @@ package websocket
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -11,19 +10,10 @@ import (
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
 	"github.com/gorilla/websocket"
-	"github.com/nite-coder/blackbear/pkg/config"
 	"github.com/nite-coder/blackbear/pkg/log"
 	"github.com/nite-coder/prelude"
 )
 
-const (
-	// Time allowed to write a message to the peer.
-	// writeWait = 10 * time.Second
-
-	// Send pings to peer with this period. Must be less than readWait.
-	pingPeriod = 20 * time.Second
-)
-
 // WSMessage 代表 websocket 底層的 message
 type WSMessage struct {
 	MsgType int
@@ -37,33 +27,53 @@ type WSSession struct {
 	lastSeenAt  time.Time
 	manager     *Manager
 	clientIP    string
-
-	id        string
-	metadata  map[string]interface{}
-	socket    *websocket.Conn
-	rooms     sync.Map
-	roomID    string // member play chatroom and use the roomID
-	inChan    chan *WSMessage
-	outChan   chan *WSMessage
-	eventChan chan cloudevents.Event
+	codec       *codec
+
+	id            string
+	identity      *Identity
+	metadataMutex sync.RWMutex
+	metadata      map[string]interface{}
+	socket        *websocket.Conn
+	rooms         sync.Map
+	registered    bool
+	inChan        chan *WSMessage
+	outChan       chan *WSMessage
+	eventChan     chan cloudevents.Event
+	closeChan     chan struct{}
+
+	// writeStartedAt is the unix nano time when the current write was started and it is zero when no write is in progress
+	writeStartedAt int64
+	// writeLatency is the duration of the last completed write in nanoseconds
+	writeLatency int64
+	// writeFinishedAt is the unix nano time when the last write was completed
+	writeFinishedAt int64
+	connectedAt     time.Time
+	// closeCode is the websocket close code of the session and only the first code is kept
+	closeCode int32
+	// slowSince is the time when the session was found slow and it is only used by the eviction loop of manager
+	slowSince time.Time
 }
 
 // NewWSSession 產生一個新的 websocket session
 func NewWSSession(id string, clientIP string, conn *websocket.Conn, manager *Manager) *WSSession {
-	inboundCount, _ := config.Int32("websocket.session_inbound_count", 128)
-	outboundCount, _ := config.Int32("websocket.session_outbound_count", 128)
-	eventCount, _ := config.Int32("websocket.session_event_count", 128)
+	subprotocol := ""
+	if conn != nil {
+		subprotocol = conn.Subprotocol()
+	}
 
 	return &WSSession{
-		manager:    manager,
-		lastSeenAt: time.Now().UTC(),
-		id:         id,
-		socket:     conn,
-		inChan:     make(chan *WSMessage, inboundCount),
-		outChan:    make(chan *WSMessage, outboundCount),
-		eventChan:  make(chan cloudevents.Event, eventCount),
-		clientIP:   clientIP,
-		metadata:   make(map[string]interface{}),
+		manager:     manager,
+		codec:       codecBySubprotocol(subprotocol),
+		lastSeenAt:  time.Now().UTC(),
+		connectedAt: time.Now().UTC(),
+		id:          id,
+		socket:      conn,
+		inChan:      make(chan *WSMessage, manager.opts.sessionInboundCount),
+		outChan:     make(chan *WSMessage, manager.opts.sessionOutboundCount),
+		eventChan:   make(chan cloudevents.Event, manager.opts.sessionEventCount),
+		closeChan:   make(chan struct{}),
+		clientIP:    clientIP,
+		metadata:    make(map[string]interface{}),
 	}
 }
 
@@ -72,14 +82,46 @@ func (s *WSSession) ID() string {
 	return s.id
 }
 
+// Subprotocol returns the negotiated subprotocol which decides the event format of the session
+func (s *WSSession) Subprotocol() string {
+	return s.codec.subprotocol
+}
+
 // LastSeenAt 取得 session 的最後獲得 pong 的時間
 func (s *WSSession) LastSeenAt() time.Time {
 	return s.lastSeenAt
 }
 
-// Metadata returns session's metadata
+// Metadata returns a copy of session's metadata
 func (s *WSSession) Metadata() map[string]interface{} {
-	return s.metadata
+	s.metadataMutex.RLock()
+	defer s.metadataMutex.RUnlock()
+
+	metadata := make(map[string]interface{}, len(s.metadata))
+	for k, v := range s.metadata {
+		metadata[k] = v
+	}
+	return metadata
+}
+
+func (s *WSSession) setMetadata(key string, val interface{}) {
+	s.metadataMutex.Lock()
+	defer s.metadataMutex.Unlock()
+	s.metadata[key] = val
+}
+
+// Identity returns the authenticated identity of the session.  It returns nil if the session is not authenticated.
+func (s *WSSession) Identity() *Identity {
+	return s.identity
+}
+
+// SetIdentity stores the user id and claims of identity in session's metadata, so they are added to every inbound event as extensions
+func (s *WSSession) SetIdentity(identity *Identity) {
+	s.identity = identity
+	for k, v := range identity.Claims {
+		s.setMetadata(k, v)
+	}
+	s.setMetadata(prelude.UserID, identity.UserID)
 }
 
 // IsActive reprsent active status of manager
@@ -101,13 +143,13 @@ func (s *WSSession) readLoop() {
 		_ = s.Close()
 	}()
 
-	pongWait, _ := config.Duration("websocket.pong_wait", 0)
+	pongWait := s.manager.opts.pongWait
 	if pongWait > 0 {
 		_ = s.socket.SetReadDeadline(time.Now().Add(pongWait))
 	}
 
 	// Maximum message size allowed from peer.
-	maxMessageSizeByte, _ := config.Int64("websocket.max_message_size_byte", 0)
+	maxMessageSizeByte := s.manager.opts.maxMessageSize
 	if maxMessageSizeByte > 0 {
 		s.socket.SetReadLimit(maxMessageSizeByte)
 	}
@@ -135,6 +177,12 @@ func (s *WSSession) readLoop() {
 
 		msgType, msgData, err = s.socket.ReadMessage()
 		if err != nil {
+			closeErr := &websocket.CloseError{}
+			if errors.As(err, &closeErr) {
+				s.setCloseCode(closeErr.Code)
+			} else {
+				s.setCloseCode(websocket.CloseAbnormalClosure)
+			}
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived, websocket.CloseAbnormalClosure) {
 				log.Err(err).Errorf("websocket: read websocket message failed")
 			}
@@ -154,7 +202,7 @@ func (s *WSSession) writeLoop() {
 	defer func() {
 		_ = s.Close()
 	}()
-	pingTicker := time.NewTicker(pingPeriod)
+	pingTicker := time.NewTicker(s.manager.opts.pingPeriod)
 	var (
 		message *WSMessage
 		err     error
@@ -167,7 +215,7 @@ func (s *WSSession) writeLoop() {
 		}
 		select {
 		case message = <-s.outChan:
-			if err = s.socket.WriteMessage(message.MsgType, message.MsgData); err != nil {
+			if err = s.writeMessage(message); err != nil {
 				if !(strings.Contains(err.Error(), "use of closed network connection") || errors.Is(err, websocket.ErrCloseSent)) {
 					log.Err(err).Warn("websocket: wrtieLoop error")
 				} else {
@@ -175,6 +223,10 @@ func (s *WSSession) writeLoop() {
 				}
 				return
 			}
+			if message.MsgType == websocket.CloseMessage {
+				log.Str("session_id", s.ID()).Debug("websocket: close message was sent")
+				return
+			}
 		case <-pingTicker.C:
 			if err := s.socket.WriteMessage(websocket.PingMessage, nil); err != nil {
 				if !(strings.Contains(err.Error(), "use of closed network connection") || errors.Is(err, websocket.ErrCloseSent)) {
@@ -188,6 +240,88 @@ func (s *WSSession) writeLoop() {
 	}
 }
 
+// writeMessage writes the message to socket and records the write latency
+func (s *WSSession) writeMessage(message *WSMessage) error {
+	startedAt := time.Now()
+	atomic.StoreInt64(&s.writeStartedAt, startedAt.UnixNano())
+	err := s.socket.WriteMessage(message.MsgType, message.MsgData)
+	finishedAt := time.Now()
+	atomic.StoreInt64(&s.writeLatency, int64(finishedAt.Sub(startedAt)))
+	atomic.StoreInt64(&s.writeFinishedAt, finishedAt.UnixNano())
+	atomic.StoreInt64(&s.writeStartedAt, 0)
+	return err
+}
+
+// WriteLatency returns the duration of the last write.  If a write is in progress and it takes longer, the elapsed time is returned.
+func (s *WSSession) WriteLatency() time.Duration {
+	latency := time.Duration(atomic.LoadInt64(&s.writeLatency))
+
+	startedAt := atomic.LoadInt64(&s.writeStartedAt)
+	if startedAt > 0 {
+		elapsed := time.Since(time.Unix(0, startedAt))
+		if elapsed > latency {
+			latency = elapsed
+		}
+	}
+	return latency
+}
+
+// recentWriteLatency returns the elapsed time of the write in progress or the duration of the last write if it was completed after since.
+// An idle session whose last write was slow isn't slow anymore once the write is older than since.
+func (s *WSSession) recentWriteLatency(now time.Time, since time.Time) time.Duration {
+	latency := time.Duration(0)
+	if atomic.LoadInt64(&s.writeFinishedAt) >= since.UnixNano() {
+		latency = time.Duration(atomic.LoadInt64(&s.writeLatency))
+	}
+
+	startedAt := atomic.LoadInt64(&s.writeStartedAt)
+	if startedAt > 0 {
+		elapsed := now.Sub(time.Unix(0, startedAt))
+		if elapsed > latency {
+			latency = elapsed
+		}
+	}
+	return latency
+}
+
+// handleCommand handles the events which are sent by Context to change the state of session
+func (s *WSSession) handleCommand(c *prelude.Context) error {
+	switch c.Event.Type() {
+	case "metadata.add":
+		item := prelude.Item{}
+		err := json.Unmarshal(c.Event.Data(), &item)
+		if err != nil {
+			return err
+		}
+		s.setMetadata(item.Key, item.Value)
+	case "room.join", "room.leave":
+		roomID := ""
+		err := json.Unmarshal(c.Event.Data(), &roomID)
+		if err != nil {
+			return err
+		}
+		if c.Event.Type() == "room.join" {
+			return s.manager.JoinRoom(roomID, s)
+		}
+		return s.manager.LeaveRoom(roomID, s)
+	}
+	return nil
+}
+
+// CloseCode returns the websocket close code of the session.  It returns zero if the session is not closed.
+func (s *WSSession) CloseCode() int {
+	return int(atomic.LoadInt32(&s.closeCode))
+}
+
+func (s *WSSession) setCloseCode(code int) {
+	atomic.CompareAndSwapInt32(&s.closeCode, 0, int32(code))
+}
+
+// QueueDepth returns the number of messages which are waiting to be written to socket
+func (s *WSSession) QueueDepth() int {
+	return len(s.outChan)
+}
+
 func (s *WSSession) eventLoop() {
 	for {
 		if !s.IsActive() {
@@ -196,31 +330,55 @@ func (s *WSSession) eventLoop() {
 		}
 		select {
 		case event := <-s.eventChan:
-			buf, err := json.Marshal(event)
+			message, err := s.codec.encode(event)
 			if err != nil {
 				log.Errorf("websocket: event marshal failed: %v", err)
 				continue
 			}
-			message := &WSMessage{websocket.TextMessage, buf}
-			s.sendMessage(message)
+			_ = s.sendMessage(message)
 		}
 	}
 }
 
 func (s *WSSession) updateRouteLoop() {
-	timer := time.NewTicker(time.Duration(60) * time.Second)
+	interval := s.manager.opts.sessionUpdateInterval
+	if interval <= 0 {
+		interval = defaultSessionUpdateInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	log.Debug("websocket: updateRouteLoop is started")
 
-	for range timer.C {
-		if !s.IsActive() {
+	for {
+		select {
+		case <-ticker.C:
+			if !s.refreshPresence() {
+				log.Debugf("websocket: updateRouteLoop is finished")
+				return
+			}
+			log.Str("session_id", s.ID()).Str("last_seen_at", s.lastSeenAt.String()).Debug("websocket: session route was updated")
+		case <-s.closeChan:
 			log.Debugf("websocket: updateRouteLoop is finished")
 			return
 		}
+	}
+}
 
-		_ = s.manager.UpdateRouteInfo(s)
+// refreshPresence refreshes the session in the presence.  It holds the lock of session, so the session isn't registered again after
+// Close deregistered it.  It returns false if the session is closed.
+func (s *WSSession) refreshPresence() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-		log.Str("session_id", s.ID()).Str("last_seen_at", s.lastSeenAt.String()).Debug("websocket: session route was updated")
+	if !s.IsActive() {
+		return false
 	}
+
+	err := s.manager.UpdateRouteInfo(s)
+	if err != nil {
+		log.Err(err).Str("session_id", s.ID()).Warn("websocket: session can't be refreshed in presence")
+	}
+	return true
 }
 
 func (s *WSSession) readMessage() *WSMessage {
@@ -228,27 +386,63 @@ func (s *WSSession) readMessage() *WSMessage {
 	return message
 }
 
-func (s *WSSession) sendMessage(msg *WSMessage) {
-	select {
-	case s.outChan <- msg:
-	default:
+func (s *WSSession) sendMessage(msg *WSMessage) error {
+	opts := s.manager.opts
+	enqueued, dropped := enqueueMessage(s.outChan, msg, opts.backpressurePolicy, opts.backpressureTimeout)
+	return s.handleBackpressure(enqueued, dropped)
+}
+
+// handleBackpressure counts the dropped events and closes the session if the policy is Disconnect
+func (s *WSSession) handleBackpressure(enqueued bool, dropped int) error {
+	if dropped > 0 {
+		s.manager.status.addDroppedEvents(dropped)
+		log.Str("session_id", s.ID()).Str("policy", s.manager.opts.backpressurePolicy.String()).Debugf("websocket: %d events were dropped", dropped)
 	}
+
+	if enqueued {
+		return nil
+	}
+
+	if s.manager.opts.backpressurePolicy == Disconnect && s.IsActive() {
+		s.manager.status.increaseDisconnectedSessions()
+		s.setCloseCode(websocket.CloseTryAgainLater)
+		log.Str("session_id", s.ID()).Warn("websocket: slow session is disconnected")
+		// the caller might be the session's own loop, so the session is closed asynchronously
+		go func() {
+			_ = s.Close()
+		}()
+	}
+
+	return ErrQueueFull
 }
 
 // SendEvent 可以傳送 event 訊息給 client (設備)
 func (s *WSSession) SendEvent(event cloudevents.Event) error {
-	_, err := toWSMessage(event)
+	_, err := s.codec.encode(event)
 	if err != nil {
 		log.Err(err).Error("websocket: event to webscoket message fail")
 		return err
 	}
 
-	select {
-	case s.eventChan <- event:
-	default:
+	opts := s.manager.opts
+	enqueued, dropped := enqueueEvent(s.eventChan, event, opts.backpressurePolicy, opts.backpressureTimeout)
+	return s.handleBackpressure(enqueued, dropped)
+}
+
+// drain sends the event and then the close frame with going away status, so the client reconnects to other gateway
+func (s *WSSession) drain(event cloudevents.Event) {
+	message, err := s.codec.encode(event)
+	if err != nil {
+		log.Err(err).Error("websocket: event to webscoket message fail")
+	} else {
+		_ = s.sendMessage(message)
 	}
 
-	return nil
+	// the close frame must be sent, so the oldest messages are dropped if the queue is full
+	s.setCloseCode(websocket.CloseGoingAway)
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is draining")
+	_, dropped := enqueueMessage(s.outChan, &WSMessage{websocket.CloseMessage, closeMessage}, DropOldest, 0)
+	_ = s.handleBackpressure(true, dropped)
 }
 
 // Close func which closes websocket session and remove session from bucket and room.
@@ -257,9 +451,28 @@ func (s *WSSession) Close() error {
 	defer s.mutex.Unlock()
 
 	if s.IsActive() {
-		_ = s.socket.Close()
-		_ = s.manager.DeleteSession(s)
+		// the session is inactive before it is deregistered, so the update route loop doesn't register it again
 		s.SetActive(false)
+		close(s.closeChan)
+		if s.socket != nil {
+			_ = s.socket.Close()
+		}
+		s.rooms.Range(func(key, _ interface{}) bool {
+			roomID, ok := key.(string)
+			if ok {
+				_ = s.manager.LeaveRoom(roomID, s)
+			}
+			return true
+		})
+		_ = s.manager.DeleteSession(s)
+		if s.registered {
+			err := s.manager.hub.Router().Presence().Deregister(s.ID())
+			if err != nil {
+				log.Err(err).Str("session_id", s.ID()).Warn("websocket: session can't be deregistered from presence")
+			}
+		}
+		s.setCloseCode(websocket.CloseNormalClosure)
+		s.manager.publishLifecycleEvent(SessionDisconnectedEventType, s)
 		log.Str("session_id", s.ID()).Debug("websocket: session was closed")
 	}
 
@@ -282,33 +495,21 @@ func (s *WSSession) Start() error {
 		return err
 	}
 
+	err = s.manager.UpdateRouteInfo(s)
+	if err != nil {
+		return err
+	}
+	s.registered = true
+	s.manager.publishLifecycleEvent(SessionConnectedEventType, s)
+
 	go s.readLoop()
 	go s.writeLoop()
 	go s.eventLoop()
 
-	isUpdateRoute, _ := config.Bool("websocket.session_update_route", false)
-	if isUpdateRoute {
+	if s.manager.opts.sessionUpdateRoute {
 		go s.updateRouteLoop()
 	}
 
-	router := s.manager.hub.Router()
-	topic := fmt.Sprintf("sess.%s", s.ID())
-	router.AddRoute(topic, func(c *prelude.Context) error {
-
-		switch c.Event.Type() {
-		case "metadata.add":
-			item := prelude.Item{}
-			err := json.Unmarshal(c.Event.Data(), &item)
-			if err != nil {
-				return err
-			}
-			s.metadata[item.Key] = item.Value
-			return nil
-		}
-
-		return s.SendEvent(c.Event)
-	})
-
 	var (
 		message *WSMessage
 	)
@@ -324,39 +525,97 @@ func (s *WSSession) Start() error {
 			continue // the channel might be closed
 		}
 
-		if message.MsgType != websocket.TextMessage {
-			log.Info("websocket: message type is not text message")
-			continue
-		}
+		s.handleMessage(message)
+	}
+}
 
-		event := cloudevents.NewEvent()
-		err = json.Unmarshal(message.MsgData, &event)
-		if err != nil {
-			log.Err(err).Str("data", string(message.MsgData)).Warn("websocket: websocket message is invalid.")
-			continue
-		}
+// handleMessage decodes the message from client and publishes it to hub
+func (s *WSSession) handleMessage(message *WSMessage) {
+	event, err := s.codec.decode(message)
+	if err != nil {
+		log.Err(err).Str("data", string(message.MsgData)).Warn("websocket: websocket message is invalid.")
+		return
+	}
 
-		err = event.Validate()
+	err = event.Validate()
+	if err != nil {
+		log.Err(err).Str("data", string(message.MsgData)).Warn("websocket: event is invalid from client")
+		return
+	}
+
+	if isReservedEventType(event.Type()) {
+		log.Str("action", event.Type()).Str("session_id", s.ID()).Warn("websocket: event type is reserved and the event from client is dropped")
+		return
+	}
+
+	// the extensions of inbound event are only set by gateway, so clients can't redirect replies to other topics or pretend to be
+	// other sessions and users, e.g. the userid extension of unauthenticated session
+	for key := range event.Extensions() {
+		event.SetExtension(key, nil)
+	}
+
+	for k, v := range s.Metadata() {
+		err = event.Context.SetExtension(k, v)
 		if err != nil {
-			log.Err(err).Str("data", string(message.MsgData)).Warn("websocket: event is invalid from client")
-			continue
+			log.Err(err).Str("session_id", s.ID()).Str("key", k).Debug("websocket: metadata can't be added to event as extension")
 		}
+	}
 
-		event.SetExtension(prelude.SessionID, s.ID())
-		for k, v := range s.metadata {
-			event.SetExtension(k, v)
-		}
+	// the routing extensions are set after metadata, so metadata of the same names, e.g. claims of token or metadata.add events,
+	// can't overwrite them
+	event.SetExtension(prelude.SessionID, s.ID())
+	event.SetExtension(prelude.NodeID, s.manager.NodeID())
+	if identity := s.Identity(); identity != nil {
+		event.SetExtension(prelude.UserID, identity.UserID)
+	} else {
+		event.SetExtension(prelude.UserID, nil)
+	}
+
+	log.Str("action", event.Type()).Str("session_id", s.ID()).Str("data", string(event.Data())).Debugf("event was received from client")
+
+	router := s.manager.hub.Router()
+	if s.manager.opts.routeCheck && router.Find(event.Type()) == nil {
+		// nobody handles the event, so the not-found handler replies to the client instead of publishing it to hub
+		_ = router.Dispatch(event.Type(), prelude.NewContext(s.manager.hub, event))
+		return
+	}
 
-		log.Str("action", event.Type()).Str("session_id", s.ID()).Str("data", string(event.Data())).Debugf("event was received from client")
-		_ = s.manager.AddEventToHub(event)
+	err = s.manager.AddEventToHub(event)
+	if errors.Is(err, ErrQueueFull) && s.manager.opts.backpressurePolicy == Disconnect {
+		s.manager.status.increaseDisconnectedSessions()
+		s.setCloseCode(websocket.CloseTryAgainLater)
+		log.Str("session_id", s.ID()).Warn("websocket: session sends events faster than they are published to hub and is disconnected")
+		_ = s.Close()
 	}
 }
 
-func toWSMessage(event cloudevents.Event) (*WSMessage, error) {
-	buf, err := json.Marshal(event)
-	if err != nil {
-		return nil, err
+// reservedEventTypes are the topics which are subscribed by gateways or whose events are only created by gateways, and
+// reservedEventPrefixes are the namespaces of node topics and reply inboxes.  The type of inbound event is its topic, so clients
+// can't send these events, otherwise they could broadcast, write into rooms and sessions of others and forge lifecycle events.
+var (
+	reservedEventTypes = []string{
+		prelude.BroadcastTopic,
+		SessionConnectedEventType,
+		SessionDisconnectedEventType,
+		SessionEvictedEventType,
 	}
-	msg := &WSMessage{websocket.TextMessage, buf}
-	return msg, nil
+	reservedEventPrefixes = []string{prelude.NodeTopicPrefix + ".", "_INBOX."}
+)
+
+func isReservedEventType(eventType string) bool {
+	eventType = strings.ToLower(eventType)
+	for _, reserved := range reservedEventTypes {
+		if eventType == strings.ToLower(reserved) {
+			return true
+		}
+	}
+	for _, prefix := range reservedEventPrefixes {
+		if strings.HasPrefix(eventType, strings.ToLower(prefix)) {
+			return true
+		}
+	}
+
+	// the room topic is "room.<id>", so the events of rooms, e.g. "room.lobby.join", are still sent by clients
+	tokens := strings.Split(eventType, ".")
+	return len(tokens) == 2 && tokens[0] == "room"
 }
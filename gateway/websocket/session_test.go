@@ -0,0 +1,308 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/nite-coder/prelude"
+	"github.com/nite-coder/prelude/hub/channel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newClientMessage(t *testing.T, eventType string, extensions map[string]interface{}) *WSMessage {
+	event := cloudevents.NewEvent()
+	event.SetID(uuid.NewString())
+	event.SetSource("client")
+	event.SetType(eventType)
+	for k, v := range extensions {
+		event.SetExtension(k, v)
+	}
+
+	message, err := codecBySubprotocol(SubprotocolJSON).encode(event)
+	require.NoError(t, err)
+	assert.Equal(t, websocket.TextMessage, message.MsgType)
+	return message
+}
+
+func TestReservedEventType(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+	manager := NewManager(hub)
+	err := manager.Start()
+	require.NoError(t, err)
+
+	received := make(chan cloudevents.Event, 1)
+	router.AddRoute("hello", func(c *prelude.Context) error {
+		received <- c.Event
+		return nil
+	})
+
+	sender := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+	sender.SetActive(true)
+	other := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+	require.NoError(t, manager.AddSession(sender))
+	require.NoError(t, manager.AddSession(other))
+
+	// the broadcast event from client isn't fanned out to other sessions
+	sender.handleMessage(newClientMessage(t, prelude.BroadcastTopic, nil))
+	sender.handleMessage(newClientMessage(t, "Broadcast", nil))
+	sender.handleMessage(newClientMessage(t, prelude.NodeTopic(manager.NodeID(), other.ID()), nil))
+
+	sender.handleMessage(newClientMessage(t, "hello", nil))
+	select {
+	case event := <-received:
+		assert.Equal(t, sender.ID(), event.Extensions()[prelude.SessionID])
+	case <-time.After(time.Second):
+		t.Fatal("event from client wasn't published")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, other.outChan, 0)
+	assert.Len(t, other.eventChan, 0)
+
+	assert.True(t, isReservedEventType("room.lobby"))
+	assert.True(t, isReservedEventType("session.connected"))
+	assert.True(t, isReservedEventType("session.disconnected"))
+	assert.True(t, isReservedEventType("session.evicted"))
+	assert.True(t, isReservedEventType("gw.node1.session1"))
+	assert.True(t, isReservedEventType("_INBOX.abc"))
+	assert.False(t, isReservedEventType("broadcasting"))
+	assert.False(t, isReservedEventType("chat.send"))
+	assert.False(t, isReservedEventType("room.lobby.join"))
+	assert.False(t, isReservedEventType("session.login"))
+}
+
+func TestRoomEventFromClient(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+	manager := NewManager(hub)
+	err := manager.Start()
+	require.NoError(t, err)
+
+	received := make(chan string, 1)
+	router.AddRoute("room.:roomID.join", func(c *prelude.Context) error {
+		received <- c.Param("roomID")
+		return nil
+	})
+
+	session := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+	session.SetActive(true)
+	require.NoError(t, manager.AddSession(session))
+
+	session.handleMessage(newClientMessage(t, "room.lobby.join", nil))
+
+	select {
+	case roomID := <-received:
+		assert.Equal(t, "lobby", roomID)
+	case <-time.After(time.Second):
+		t.Fatal("room event from client didn't reach its handler")
+	}
+}
+
+func TestReservedExtensions(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+	manager := NewManager(hub, WithNodeID("node1"))
+	err := manager.Start()
+	require.NoError(t, err)
+
+	received := make(chan cloudevents.Event, 1)
+	router.AddRoute("hello", func(c *prelude.Context) error {
+		received <- c.Event
+		return nil
+	})
+
+	session := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+	session.SetActive(true)
+	require.NoError(t, manager.AddSession(session))
+
+	session.handleMessage(newClientMessage(t, "hello", map[string]interface{}{
+		prelude.ReplyTo:       prelude.BroadcastTopic,
+		prelude.CorrelationID: "forged",
+		prelude.SessionID:     "other_session",
+		prelude.NodeID:        "other_node",
+	}))
+
+	select {
+	case event := <-received:
+		extensions := event.Extensions()
+		assert.Equal(t, session.ID(), extensions[prelude.SessionID])
+		assert.Equal(t, "node1", extensions[prelude.NodeID])
+		assert.NotContains(t, extensions, prelude.ReplyTo)
+		assert.NotContains(t, extensions, prelude.CorrelationID)
+	case <-time.After(time.Second):
+		t.Fatal("event from client wasn't published")
+	}
+}
+
+func TestMetadataDoesNotOverwriteRouting(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+	manager := NewManager(hub, WithNodeID("node1"))
+	err := manager.Start()
+	require.NoError(t, err)
+
+	received := make(chan cloudevents.Event, 1)
+	router.AddRoute("hello", func(c *prelude.Context) error {
+		received <- c.Event
+		return nil
+	})
+
+	// the claims of token and metadata.add events use the names of routing extensions
+	session := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+	session.SetIdentity(&Identity{UserID: "user1", Claims: map[string]interface{}{
+		prelude.SessionID: "other_session",
+		prelude.NodeID:    "other_node",
+	}})
+	session.setMetadata(prelude.UserID, "admin")
+	session.SetActive(true)
+	require.NoError(t, manager.AddSession(session))
+
+	session.handleMessage(newClientMessage(t, "hello", nil))
+
+	select {
+	case event := <-received:
+		extensions := event.Extensions()
+		assert.Equal(t, session.ID(), extensions[prelude.SessionID])
+		assert.Equal(t, "node1", extensions[prelude.NodeID])
+		assert.Equal(t, "user1", extensions[prelude.UserID])
+	case <-time.After(time.Second):
+		t.Fatal("event from client wasn't published")
+	}
+}
+
+func TestForgedIdentityExtensions(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+	manager := NewManager(hub)
+	err := manager.Start()
+	require.NoError(t, err)
+
+	received := make(chan *prelude.Context, 1)
+	router.AddRoute("hello", func(c *prelude.Context) error {
+		received <- c
+		return nil
+	})
+
+	forged := map[string]interface{}{
+		prelude.UserID: "admin",
+		"role":         "admin",
+	}
+
+	// the session isn't authenticated
+	anonymous := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+	anonymous.SetActive(true)
+	require.NoError(t, manager.AddSession(anonymous))
+	anonymous.handleMessage(newClientMessage(t, "hello", forged))
+
+	select {
+	case c := <-received:
+		assert.Equal(t, "", c.UserID())
+		assert.Nil(t, c.Get("role"))
+	case <-time.After(time.Second):
+		t.Fatal("event from client wasn't published")
+	}
+
+	// the token of session doesn't have role claim
+	user := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+	user.SetIdentity(&Identity{UserID: "user1"})
+	user.SetActive(true)
+	require.NoError(t, manager.AddSession(user))
+	user.handleMessage(newClientMessage(t, "hello", forged))
+
+	select {
+	case c := <-received:
+		assert.Equal(t, "user1", c.UserID())
+		assert.Nil(t, c.Get("role"))
+	case <-time.After(time.Second):
+		t.Fatal("event from client wasn't published")
+	}
+}
+
+func TestRouteNotFound(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+	manager := NewManager(hub, WithRouteCheck(true))
+	err := manager.Start()
+	require.NoError(t, err)
+
+	router.AddRoute("chat.send", func(c *prelude.Context) error {
+		return nil
+	})
+
+	session := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+	session.SetActive(true)
+	require.NoError(t, manager.AddSession(session))
+
+	message := newClientMessage(t, "chat.sned", nil)
+	session.handleMessage(message)
+
+	select {
+	case event := <-session.eventChan:
+		sent, err := session.codec.decode(message)
+		require.NoError(t, err)
+		assert.Equal(t, prelude.RouteNotFoundEventType, event.Type())
+		assert.Equal(t, sent.ID(), event.Extensions()[prelude.CorrelationID])
+		assert.JSONEq(t, `{"type":"chat.sned"}`, string(event.Data()))
+	case <-time.After(time.Second):
+		t.Fatal("client didn't receive route.not_found event")
+	}
+}
+
+// recordingHub records the topics which are published to hub
+type recordingHub struct {
+	prelude.Huber
+	published chan string
+}
+
+func (h *recordingHub) Publish(topic string, event cloudevents.Event) error {
+	h.published <- topic
+	return h.Huber.Publish(topic, event)
+}
+
+func TestPublishWithoutLocalRoute(t *testing.T) {
+	// the handlers run in other processes, so the router of gateway doesn't have the route of event
+	hub := &recordingHub{Huber: channel.NewChannelHub(channel.HubOptions{}), published: make(chan string, 8)}
+	prelude.NewRouter("prelude", hub)
+	manager := NewManager(hub)
+	err := manager.Start()
+	require.NoError(t, err)
+
+	session := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+	session.SetActive(true)
+	require.NoError(t, manager.AddSession(session))
+
+	session.handleMessage(newClientMessage(t, "chat.send", nil))
+
+	select {
+	case topic := <-hub.published:
+		assert.Equal(t, "chat.send", topic)
+	case <-time.After(time.Second):
+		t.Fatal("event from client wasn't published to hub")
+	}
+}
+
+func TestSessionCloseDeregistersPresence(t *testing.T) {
+	hub := channel.NewChannelHub(channel.HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+	manager := NewManager(hub, WithSessionUpdateRoute(true), WithSessionUpdateInterval(time.Millisecond))
+
+	session := NewWSSession(uuid.NewString(), "127.0.0.1", nil, manager)
+	session.SetActive(true)
+	require.NoError(t, manager.AddSession(session))
+	require.NoError(t, manager.UpdateRouteInfo(session))
+	session.registered = true
+	go session.updateRouteLoop()
+
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, session.Close())
+
+	// the update route loop doesn't register the closed session again
+	time.Sleep(20 * time.Millisecond)
+	_, err := router.Presence().Lookup(session.ID())
+	assert.ErrorIs(t, err, prelude.ErrSessionNotFound)
+}
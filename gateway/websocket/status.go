@@ -5,6 +5,14 @@ import "sync/atomic"
 // Status 用來表示 Gateway 的狀態，例如: 連線人數
 type Status struct {
 	OnlinePeople int64 `json:"online_people"`
+	// DroppedEvents is the number of events which were dropped because the outbound queues of session were full
+	DroppedEvents int64 `json:"dropped_events"`
+	// DroppedHubEvents is the number of events which were dropped because the hub queue was full
+	DroppedHubEvents int64 `json:"dropped_hub_events"`
+	// DisconnectedSessions is the number of slow sessions which were closed by Disconnect policy
+	DisconnectedSessions int64 `json:"disconnected_sessions"`
+	// EvictedSessions is the number of slow sessions which were evicted by slow consumer detection
+	EvictedSessions int64 `json:"evicted_sessions"`
 }
 
 func (s *Status) increaseOnlinePeople() {
@@ -14,3 +22,19 @@ func (s *Status) increaseOnlinePeople() {
 func (s *Status) decreaseOnlinePeople() {
 	atomic.AddInt64(&s.OnlinePeople, -1)
 }
+
+func (s *Status) addDroppedEvents(count int) {
+	atomic.AddInt64(&s.DroppedEvents, int64(count))
+}
+
+func (s *Status) addDroppedHubEvents(count int) {
+	atomic.AddInt64(&s.DroppedHubEvents, int64(count))
+}
+
+func (s *Status) increaseDisconnectedSessions() {
+	atomic.AddInt64(&s.DisconnectedSessions, 1)
+}
+
+func (s *Status) increaseEvictedSessions() {
+	atomic.AddInt64(&s.EvictedSessions, 1)
+}
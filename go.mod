@@ -10,7 +10,7 @@ require (
 	github.com/golang/mock v1.6.0
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/websocket v1.5.0
-	github.com/nats-io/nats-server/v2 v2.9.15 // indirect
+	github.com/nats-io/nats-server/v2 v2.9.15
 	github.com/nats-io/nats.go v1.25.0
 	github.com/nite-coder/blackbear v0.0.0-20230316123859-b7d04f486c2c
 	github.com/stretchr/testify v1.8.2
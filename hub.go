@@ -1,10 +1,26 @@
 package prelude
 
-import cloudevents "github.com/cloudevents/sdk-go/v2"
+import (
+	"context"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+// DefaultRequestTimeout is used by Huber.Request when the context doesn't have a deadline
+var DefaultRequestTimeout = 10 * time.Second
 
 type Huber interface {
 	Router() *Router
 	SetRouter(router *Router)
 	Publish(topic string, event cloudevents.Event) error
+	// QueueSubscribe subscribes the topic with the queue group of hub, so each event is handled by one member of the group
 	QueueSubscribe(topic string) error
+	// Subscribe subscribes the topic without queue group, so each event is handled by every instance
+	Subscribe(topic string) error
+	// Unsubscribe stops receiving events of the topic which is subscribed by QueueSubscribe
+	Unsubscribe(topic string) error
+	// Request publishes the event to the topic and waits for the reply event which is correlated to the event.  If the reply is an
+	// error event, e.g. "<type>.error", the reply and the error which it carries are returned.
+	Request(ctx context.Context, topic string, event cloudevents.Event) (cloudevents.Event, error)
 }
@@ -1,4 +1,268 @@
-package prelude
+package channel
 
-type ChannelHub struct {
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/google/uuid"
+	"github.com/nite-coder/blackbear/pkg/cast"
+	"github.com/nite-coder/blackbear/pkg/log"
+	"github.com/nite-coder/prelude"
+)
+
+const defaultBufferSize = 1024
+
+// Bus delivers events between channel hubs in the same process
+type Bus struct {
+	next          uint64
+	dropped       uint64
+	mutex         sync.RWMutex
+	subscriptions []*subscription
+}
+
+// NewBus returns a Bus instance
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+type message struct {
+	topic string
+	event cloudevents.Event
+}
+
+type subscription struct {
+	topic       string
+	group       string
+	messageChan chan message
+	done        chan struct{}
+}
+
+func newSubscription(topic, group string, bufferSize int) *subscription {
+	return &subscription{
+		topic:       topic,
+		group:       group,
+		messageChan: make(chan message, bufferSize),
+		done:        make(chan struct{}),
+	}
+}
+
+func (b *Bus) subscribe(sub *subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscriptions = append(b.subscriptions, sub)
+}
+
+func (b *Bus) unsubscribe(sub *subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for idx, element := range b.subscriptions {
+		if element == sub {
+			b.subscriptions = append(b.subscriptions[:idx], b.subscriptions[idx+1:]...)
+			close(sub.done)
+			return
+		}
+	}
+}
+
+// publish delivers the event to every subscription without group and to one member of each group
+func (b *Bus) publish(topic string, event cloudevents.Event) {
+	b.mutex.RLock()
+	targets := []*subscription{}
+	groups := map[string][]*subscription{}
+	for _, sub := range b.subscriptions {
+		if !match(sub.topic, topic) {
+			continue
+		}
+		if sub.group == "" {
+			targets = append(targets, sub)
+			continue
+		}
+		groups[sub.group] = append(groups[sub.group], sub)
+	}
+	b.mutex.RUnlock()
+
+	for _, members := range groups {
+		idx := atomic.AddUint64(&b.next, 1) % uint64(len(members))
+		targets = append(targets, members[idx])
+	}
+
+	// the event is dropped if the queue of subscription is full like a slow consumer of NATS, otherwise a handler which publishes
+	// to its own topic would wait for itself forever
+	for _, sub := range targets {
+		select {
+		case sub.messageChan <- message{topic: topic, event: event.Clone()}:
+		case <-sub.done:
+		default:
+			atomic.AddUint64(&b.dropped, 1)
+			log.Str("topic", topic).Str("subscription", sub.topic).Warn("hub: subscription is a slow consumer and the event is dropped")
+		}
+	}
+}
+
+// Dropped returns the number of events which were dropped because the queues of subscriptions were full
+func (b *Bus) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+// match reports whether the topic matches the subscribed pattern.  "*" matches a single token and ">" matches one or more tokens.
+func match(pattern, topic string) bool {
+	patterns := strings.Split(pattern, ".")
+	topics := strings.Split(topic, ".")
+
+	for idx, p := range patterns {
+		if p == ">" {
+			return len(topics) > idx
+		}
+		if idx >= len(topics) {
+			return false
+		}
+		if p != "*" && p != topics[idx] {
+			return false
+		}
+	}
+	return len(patterns) == len(topics)
+}
+
+// Hub is an in-process hub which uses go channels to deliver events
+type Hub struct {
+	mutex         sync.Mutex
+	router        *prelude.Router
+	bus           *Bus
+	group         string
+	bufferSize    int
+	subscriptions map[string]*subscription
+}
+
+// HubOptions is the options of channel hub
+type HubOptions struct {
+	Group string
+	// Bus is shared by hubs which need to receive events from each other.  A new bus is created if it is nil.
+	Bus *Bus
+	// BufferSize is the capacity of the event queue of each subscription
+	BufferSize int
+}
+
+// NewChannelHub returns a channel hub instance
+func NewChannelHub(opts HubOptions) prelude.Huber {
+	bus := opts.Bus
+	if bus == nil {
+		bus = NewBus()
+	}
+
+	bufferSize := opts.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+
+	hub := Hub{
+		bus:           bus,
+		group:         opts.Group,
+		bufferSize:    bufferSize,
+		subscriptions: map[string]*subscription{},
+	}
+
+	return &hub
+}
+
+func (hub *Hub) Router() *prelude.Router {
+	return hub.router
+}
+
+func (hub *Hub) SetRouter(router *prelude.Router) {
+	hub.router = router
+}
+
+func (hub *Hub) Publish(topic string, event cloudevents.Event) error {
+	err := event.Validate()
+	if err != nil {
+		return err
+	}
+
+	hub.bus.publish(topic, event)
+	return nil
+}
+
+func (hub *Hub) QueueSubscribe(topic string) error {
+	return hub.subscribe(topic, hub.group)
+}
+
+func (hub *Hub) Subscribe(topic string) error {
+	return hub.subscribe(topic, "")
+}
+
+func (hub *Hub) subscribe(topic string, group string) error {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	// the topic is subscribed once, otherwise the event is handled more than once
+	if _, found := hub.subscriptions[topic]; found {
+		return nil
+	}
+
+	sub := newSubscription(topic, group, hub.bufferSize)
+	hub.bus.subscribe(sub)
+	hub.subscriptions[topic] = sub
+
+	go func() {
+		for {
+			select {
+			case msg := <-sub.messageChan:
+				c := prelude.NewContext(hub, msg.event)
+				_ = hub.router.Dispatch(msg.topic, c)
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (hub *Hub) Unsubscribe(topic string) error {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	sub, found := hub.subscriptions[topic]
+	if !found {
+		return nil
+	}
+
+	hub.bus.unsubscribe(sub)
+	delete(hub.subscriptions, topic)
+	return nil
+}
+
+func (hub *Hub) Request(ctx context.Context, topic string, event cloudevents.Event) (cloudevents.Event, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, prelude.DefaultRequestTimeout)
+		defer cancel()
+	}
+
+	inbox := newSubscription("_INBOX."+uuid.NewString(), "", 1)
+	hub.bus.subscribe(inbox)
+	defer hub.bus.unsubscribe(inbox)
+
+	event = event.Clone()
+	event.SetExtension(prelude.ReplyTo, inbox.topic)
+	err := hub.Publish(topic, event)
+	if err != nil {
+		return cloudevents.Event{}, err
+	}
+
+	for {
+		select {
+		case msg := <-inbox.messageChan:
+			correlationID, _ := cast.ToString(msg.event.Extensions()[prelude.CorrelationID])
+			if correlationID == event.ID() {
+				return msg.event, prelude.ReplyError(msg.event)
+			}
+		case <-ctx.Done():
+			return cloudevents.Event{}, ctx.Err()
+		}
+	}
 }
@@ -0,0 +1,346 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/google/uuid"
+	"github.com/nite-coder/prelude"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type Item struct {
+	Message string
+}
+
+func newEvent(eventType string) cloudevents.Event {
+	event := cloudevents.NewEvent()
+	event.SetID(uuid.NewString())
+	event.SetSource("client")
+	event.SetType(eventType)
+	return event
+}
+
+func TestPublishAndQueueSubscribe(t *testing.T) {
+	sessionID := "my_session_id"
+
+	hub := NewChannelHub(HubOptions{})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	router := prelude.NewRouter("prelude", hub)
+
+	err := router.Presence().Register(prelude.SessionInfo{SessionID: sessionID, NodeID: "node1"})
+	require.NoError(t, err)
+
+	router.AddRoute(prelude.NodeTopic("node1", sessionID), func(c *prelude.Context) error {
+		defer func() {
+			wg.Done()
+		}()
+
+		assert.Equal(t, "pong", string(c.Event.Type()))
+		assert.Equal(t, "\"done\"", string(c.Event.Data()))
+
+		return nil
+	})
+
+	router.AddRoute("ping", func(c *prelude.Context) error {
+		defer func() {
+			wg.Done()
+		}()
+
+		item := Item{}
+		err := c.BindJSON(&item)
+		require.NoError(t, err)
+
+		assert.Equal(t, "hello world", item.Message)
+		assert.Equal(t, cloudevents.ApplicationJSON, c.Event.DataContentType())
+		assert.Equal(t, sessionID, c.Get(prelude.SessionID))
+
+		return c.JSON("pong", "done")
+	})
+
+	pingEvent := newEvent("ping")
+	pingEvent.SetExtension(prelude.SessionID, sessionID)
+
+	data := []byte(`{"message":"hello world"}`)
+	err = pingEvent.SetData(cloudevents.ApplicationJSON, data)
+	require.NoError(t, err)
+
+	err = hub.Publish(pingEvent.Type(), pingEvent)
+	require.NoError(t, err)
+
+	wg.Wait()
+}
+
+func TestQueueGroup(t *testing.T) {
+	bus := NewBus()
+
+	var wg sync.WaitGroup
+	var workerCount, auditCount int32
+
+	newHub := func(group string, counter *int32) {
+		hub := NewChannelHub(HubOptions{Group: group, Bus: bus})
+		router := prelude.NewRouter("prelude", hub)
+		router.AddRoute("order.:orderID.created", func(c *prelude.Context) error {
+			defer wg.Done()
+			assert.Equal(t, "o1", c.Param("orderID"))
+			atomic.AddInt32(counter, 1)
+			return nil
+		})
+	}
+
+	newHub("worker", &workerCount)
+	newHub("worker", &workerCount)
+	newHub("audit", &auditCount)
+
+	publisher := NewChannelHub(HubOptions{Bus: bus})
+
+	total := 10
+	wg.Add(total * 2)
+	for i := 0; i < total; i++ {
+		err := publisher.Publish("order.o1.created", newEvent("order.created"))
+		require.NoError(t, err)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(total), atomic.LoadInt32(&workerCount))
+	assert.Equal(t, int32(total), atomic.LoadInt32(&auditCount))
+}
+
+func TestBroadcastDelivery(t *testing.T) {
+	bus := NewBus()
+
+	var wg sync.WaitGroup
+	var queueCount, broadcastCount int32
+
+	for i := 0; i < 3; i++ {
+		hub := NewChannelHub(HubOptions{Group: "worker", Bus: bus})
+		router := prelude.NewRouter("prelude", hub)
+		router.AddRoute("order.created", func(c *prelude.Context) error {
+			defer wg.Done()
+			atomic.AddInt32(&queueCount, 1)
+			return nil
+		})
+		router.AddRoute("cache.invalidated", func(c *prelude.Context) error {
+			defer wg.Done()
+			atomic.AddInt32(&broadcastCount, 1)
+			return nil
+		}, prelude.WithDelivery(prelude.BroadcastDelivery))
+	}
+
+	publisher := NewChannelHub(HubOptions{Bus: bus})
+
+	wg.Add(1 + 3)
+	err := publisher.Publish("order.created", newEvent("order.created"))
+	require.NoError(t, err)
+	err = publisher.Publish("cache.invalidated", newEvent("cache.invalidated"))
+	require.NoError(t, err)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queueCount))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&broadcastCount))
+}
+
+func TestErrorEvent(t *testing.T) {
+	sessionID := "my_session_id"
+
+	hub := NewChannelHub(HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+
+	router.AddRoute("room.join", func(c *prelude.Context) error {
+		return prelude.NewError("room.full", "the room is full").WithDetails(map[string]int{"capacity": 2})
+	})
+	router.AddRoute("room.leave", func(c *prelude.Context) error {
+		return errors.New("database is down")
+	})
+
+	errorEvents := make(chan cloudevents.Event, 2)
+	router.AddRoute(prelude.NodeTopic("node1", sessionID), func(c *prelude.Context) error {
+		errorEvents <- c.Event
+		return nil
+	})
+
+	joinEvent := newEvent("room.join")
+	joinEvent.SetExtension(prelude.SessionID, sessionID)
+	joinEvent.SetExtension(prelude.NodeID, "node1")
+	err := hub.Publish(joinEvent.Type(), joinEvent)
+	require.NoError(t, err)
+
+	event := <-errorEvents
+	assert.Equal(t, "room.join.error", event.Type())
+	assert.Equal(t, joinEvent.ID(), event.Extensions()[prelude.CorrelationID])
+	assert.JSONEq(t, `{"code":"room.full","message":"the room is full","details":{"capacity":2}}`, string(event.Data()))
+
+	// untyped error isn't leaked to the sender
+	leaveEvent := newEvent("room.leave")
+	leaveEvent.SetExtension(prelude.SessionID, sessionID)
+	leaveEvent.SetExtension(prelude.NodeID, "node1")
+	err = hub.Publish(leaveEvent.Type(), leaveEvent)
+	require.NoError(t, err)
+
+	event = <-errorEvents
+	assert.Equal(t, "room.leave.error", event.Type())
+	assert.JSONEq(t, `{"code":"internal","message":"internal error"}`, string(event.Data()))
+}
+
+func TestWriteToUnknownSession(t *testing.T) {
+	hub := NewChannelHub(HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+
+	errs := make(chan error, 1)
+	router.AddRoute("notify", func(c *prelude.Context) error {
+		errs <- c.JSON("notice", "hello", "unknown_session")
+		return nil
+	})
+
+	err := hub.Publish("notify", newEvent("notify"))
+	require.NoError(t, err)
+
+	// the event isn't published to a topic which nobody subscribes
+	assert.ErrorIs(t, <-errs, prelude.ErrSessionNotFound)
+}
+
+func TestPanicRecovery(t *testing.T) {
+	hub := NewChannelHub(HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+
+	done := make(chan struct{})
+	router.AddRoute("game.>", func(c *prelude.Context) error {
+		if c.Event.Type() == "game.crash" {
+			panic("bad handler")
+		}
+		close(done)
+		return nil
+	})
+
+	err := hub.Publish("game.crash", newEvent("game.crash"))
+	require.NoError(t, err)
+	err = hub.Publish("game.start", newEvent("game.start"))
+	require.NoError(t, err)
+
+	// the subscription keeps dispatching events after the panic
+	<-done
+	assert.Equal(t, uint64(1), router.PanicCount())
+}
+
+func TestSlowConsumer(t *testing.T) {
+	bus := NewBus()
+	hub := NewChannelHub(HubOptions{Bus: bus, BufferSize: 2})
+	router := prelude.NewRouter("prelude", hub)
+
+	done := make(chan struct{})
+	router.AddRoute("echo.>", func(c *prelude.Context) error {
+		if c.Event.Type() != "echo.start" {
+			return nil
+		}
+
+		// the handler publishes to its own topic more events than the queue can hold
+		for i := 0; i < 10; i++ {
+			err := hub.Publish("echo.again", newEvent("echo.again"))
+			require.NoError(t, err)
+		}
+		close(done)
+		return nil
+	})
+
+	err := hub.Publish("echo.start", newEvent("echo.start"))
+	require.NoError(t, err)
+
+	select {
+	case <-done:
+		assert.Equal(t, uint64(8), bus.Dropped())
+	case <-time.After(time.Second):
+		t.Fatal("handler which publishes to its own topic is blocked")
+	}
+}
+
+func TestRequestAndReply(t *testing.T) {
+	hub := NewChannelHub(HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+
+	router.AddRoute("echo", func(c *prelude.Context) error {
+		item := Item{}
+		err := c.BindJSON(&item)
+		require.NoError(t, err)
+		return c.Reply(item)
+	})
+
+	event := newEvent("echo")
+	err := event.SetData(cloudevents.ApplicationJSON, Item{Message: "hello"})
+	require.NoError(t, err)
+
+	reply, err := hub.Request(context.Background(), "echo", event)
+	require.NoError(t, err)
+	assert.Equal(t, "echo.reply", reply.Type())
+	assert.Equal(t, event.ID(), reply.Extensions()[prelude.CorrelationID])
+
+	item := Item{}
+	err = reply.DataAs(&item)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", item.Message)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = hub.Request(ctx, "nobody", newEvent("nobody"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRequestErrorReply(t *testing.T) {
+	hub := NewChannelHub(HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+
+	router.AddRoute("room.join", func(c *prelude.Context) error {
+		return prelude.NewError("room.full", "the room is full")
+	})
+
+	reply, err := hub.Request(context.Background(), "room.join", newEvent("room.join"))
+	var typedErr *prelude.Error
+	require.True(t, errors.As(err, &typedErr))
+	assert.Equal(t, "room.full", typedErr.Code)
+	assert.Equal(t, "room.join.error", reply.Type())
+}
+
+func TestUnsubscribe(t *testing.T) {
+	hub := NewChannelHub(HubOptions{})
+	router := prelude.NewRouter("prelude", hub)
+
+	received := int32(0)
+	router.AddRoute("hello", func(c *prelude.Context) error {
+		atomic.AddInt32(&received, 1)
+		return nil
+	})
+	// the topic is only subscribed once
+	router.AddRoute("hello", func(c *prelude.Context) error {
+		atomic.AddInt32(&received, 1)
+		return nil
+	})
+
+	err := hub.Publish("hello", newEvent("hello"))
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&received))
+
+	router.RemoveRoute("hello")
+
+	err = hub.Publish("hello", newEvent("hello"))
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&received))
+}
+
+func TestMatch(t *testing.T) {
+	assert.True(t, match("hello", "hello"))
+	assert.True(t, match("room.*.join", "room.abc.join"))
+	assert.True(t, match("room.>", "room.abc.join"))
+	assert.False(t, match("room.>", "room"))
+	assert.False(t, match("room.*", "room.abc.join"))
+	assert.False(t, match("hello", "hello.world"))
+}
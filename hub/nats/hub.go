@@ -1,39 +1,236 @@
 package nats
 
 import (
+	"context"
 	"encoding/json"
+	"sync"
+	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
 	natsClient "github.com/nats-io/nats.go"
+	"github.com/nite-coder/blackbear/pkg/cast"
 	"github.com/nite-coder/blackbear/pkg/log"
 	"github.com/nite-coder/prelude"
 )
 
+const defaultReconnectWait = 2 * time.Second
+
 type Hub struct {
-	router *prelude.Router
-	conn   *natsClient.Conn
-	group  string
+	mutex         sync.RWMutex
+	router        *prelude.Router
+	opts          HubOptions
+	natsOpts      []natsClient.Option
+	conn          *natsClient.Conn
+	group         string
+	subscriptions map[string]*natsClient.Subscription
+	// pending keeps the topics (and their queue group) which failed to be resubscribed after reconnecting.  They are retried
+	// until they are subscribed or unsubscribed.
+	pending map[string]string
+	// huber is the hub which is passed to handlers.  It is the JetStream hub when this hub is embedded by it.
+	huber prelude.Huber
+	// reconnected is called after the connection and subscriptions were re-established
+	reconnected func(conn *natsClient.Conn)
 }
 
 type HubOptions struct {
 	URL   string
 	Group string
+	// Name is the connection name which is shown in NATS monitoring
+	Name string
+	// ReconnectWait is the wait time between reconnect attempts.  Default is 2 seconds.
+	ReconnectWait time.Duration
+	// MaxReconnects is the max number of reconnect attempts.  Zero uses the NATS default (60) and negative value reconnects forever.
+	// The hub connects again and re-establishes all subscriptions when the connection is closed after max reconnects.
+	MaxReconnects int
+	// ReconnectBufferSize is the size in bytes of buffer which keeps published events while reconnecting.  Zero uses the NATS
+	// default (8MB) and negative value disables the buffer.
+	ReconnectBufferSize int
+	// CredentialsFile is the user credentials file (JWT and NKey seed)
+	CredentialsFile string
+	// NKeyFile is the NKey seed file
+	NKeyFile string
+	// TLSCertFile and TLSKeyFile are the client certificate and key files
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSCAFile is the root CA file which verifies the server certificate
+	TLSCAFile string
+	// OnDisconnect is called when the connection is disconnected
+	OnDisconnect func(err error)
+	// OnReconnect is called when the connection is reconnected
+	OnReconnect func()
 }
 
-// TODO: we need to manage connection later in case the connect is disconnected
 func NewNatsHub(opts HubOptions) (prelude.Huber, error) {
-	nc, err := natsClient.Connect(opts.URL)
+	if opts.ReconnectWait <= 0 {
+		opts.ReconnectWait = defaultReconnectWait
+	}
+
+	hub := Hub{
+		opts:          opts,
+		group:         opts.Group,
+		subscriptions: map[string]*natsClient.Subscription{},
+		pending:       map[string]string{},
+	}
+
+	natsOpts, err := hub.natsOptions()
 	if err != nil {
 		return nil, err
 	}
+	hub.natsOpts = natsOpts
 
-	hub := Hub{
-		conn: nc,
+	nc, err := natsClient.Connect(opts.URL, natsOpts...)
+	if err != nil {
+		return nil, err
 	}
+	hub.conn = nc
+	hub.huber = &hub
 
 	return &hub, nil
 }
 
+// natsOptions converts HubOptions to the options of NATS connection
+func (hub *Hub) natsOptions() ([]natsClient.Option, error) {
+	opts := hub.opts
+	natsOpts := []natsClient.Option{
+		natsClient.ReconnectWait(opts.ReconnectWait),
+		natsClient.DisconnectErrHandler(func(_ *natsClient.Conn, err error) {
+			log.Err(err).Warn("hub: nats connection was disconnected")
+			if opts.OnDisconnect != nil {
+				opts.OnDisconnect(err)
+			}
+		}),
+		natsClient.ReconnectHandler(func(conn *natsClient.Conn) {
+			log.Str("url", conn.ConnectedUrl()).Info("hub: nats connection was reconnected")
+			if opts.OnReconnect != nil {
+				opts.OnReconnect()
+			}
+		}),
+		natsClient.ClosedHandler(func(conn *natsClient.Conn) {
+			go hub.reconnect(conn)
+		}),
+	}
+
+	if opts.Name != "" {
+		natsOpts = append(natsOpts, natsClient.Name(opts.Name))
+	}
+
+	if opts.MaxReconnects != 0 {
+		natsOpts = append(natsOpts, natsClient.MaxReconnects(opts.MaxReconnects))
+	}
+
+	if opts.ReconnectBufferSize != 0 {
+		natsOpts = append(natsOpts, natsClient.ReconnectBufSize(opts.ReconnectBufferSize))
+	}
+
+	if opts.CredentialsFile != "" {
+		natsOpts = append(natsOpts, natsClient.UserCredentials(opts.CredentialsFile))
+	}
+
+	if opts.NKeyFile != "" {
+		nkeyOpt, err := natsClient.NkeyOptionFromSeed(opts.NKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		natsOpts = append(natsOpts, nkeyOpt)
+	}
+
+	if opts.TLSCertFile != "" || opts.TLSKeyFile != "" {
+		natsOpts = append(natsOpts, natsClient.ClientCert(opts.TLSCertFile, opts.TLSKeyFile))
+	}
+
+	if opts.TLSCAFile != "" {
+		natsOpts = append(natsOpts, natsClient.RootCAs(opts.TLSCAFile))
+	}
+
+	return natsOpts, nil
+}
+
+// reconnect connects to NATS again after the connection was closed by exceeding max reconnects and re-establishes all subscriptions
+func (hub *Hub) reconnect(closed *natsClient.Conn) {
+	hub.mutex.RLock()
+	current := hub.conn
+	hub.mutex.RUnlock()
+	if closed != current {
+		return
+	}
+
+	log.Str("url", hub.opts.URL).Warn("hub: nats connection was closed and the hub is connecting again")
+
+	for {
+		time.Sleep(hub.opts.ReconnectWait)
+
+		nc, err := natsClient.Connect(hub.opts.URL, hub.natsOpts...)
+		if err != nil {
+			log.Err(err).Warn("hub: connect to nats failed")
+			continue
+		}
+
+		hub.mutex.Lock()
+		hub.conn = nc
+		for topic, old := range hub.subscriptions {
+			// the subscription of closed connection is dead, so it's kept in pending until it is subscribed again
+			delete(hub.subscriptions, topic)
+			hub.pending[topic] = old.Queue
+		}
+		hub.subscribePending()
+		retry := len(hub.pending) > 0
+		hub.mutex.Unlock()
+
+		if retry {
+			go hub.retryResubscribe(nc)
+		}
+
+		log.Str("url", nc.ConnectedUrl()).Info("hub: nats connection and subscriptions were re-established")
+		if hub.reconnected != nil {
+			hub.reconnected(nc)
+		}
+		if hub.opts.OnReconnect != nil {
+			hub.opts.OnReconnect()
+		}
+		return
+	}
+}
+
+// subscribePending subscribes the pending topics with the current connection.  The caller must hold the lock.
+func (hub *Hub) subscribePending() {
+	for topic, group := range hub.pending {
+		sub, err := hub.subscribe(topic, group)
+		if err != nil {
+			log.Err(err).Str("topic", topic).Error("hub: resubscribe to nats failed")
+			continue
+		}
+		delete(hub.pending, topic)
+		hub.subscriptions[topic] = sub
+	}
+}
+
+// retryResubscribe retries the pending topics every reconnect wait until all of them are subscribed or the connection is replaced
+func (hub *Hub) retryResubscribe(conn *natsClient.Conn) {
+	for {
+		time.Sleep(hub.opts.ReconnectWait)
+
+		hub.mutex.Lock()
+		if hub.conn != conn || conn.IsClosed() {
+			hub.mutex.Unlock()
+			return
+		}
+		hub.subscribePending()
+		done := len(hub.pending) == 0
+		hub.mutex.Unlock()
+
+		if done {
+			log.Str("url", conn.ConnectedUrl()).Info("hub: nats subscriptions were re-established")
+			return
+		}
+	}
+}
+
+func (hub *Hub) connection() *natsClient.Conn {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+	return hub.conn
+}
+
 func (hub *Hub) Router() *prelude.Router {
 	return hub.router
 }
@@ -53,7 +250,7 @@ func (hub *Hub) Publish(topic string, event cloudevents.Event) error {
 		return err
 	}
 
-	err = hub.conn.Publish(topic, b)
+	err = hub.connection().Publish(topic, b)
 	if err != nil {
 		log.Err(err).Str("data", string(b)).Error("hub: publish to nats failed")
 		return err
@@ -63,7 +260,36 @@ func (hub *Hub) Publish(topic string, event cloudevents.Event) error {
 }
 
 func (hub *Hub) QueueSubscribe(topic string) error {
-	_, err := hub.conn.QueueSubscribe(topic, hub.group, func(msg *natsClient.Msg) {
+	return hub.addSubscription(topic, hub.group)
+}
+
+func (hub *Hub) Subscribe(topic string) error {
+	return hub.addSubscription(topic, "")
+}
+
+func (hub *Hub) addSubscription(topic string, group string) error {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	// the topic is subscribed once, otherwise the event is handled more than once
+	if _, found := hub.subscriptions[topic]; found {
+		return nil
+	}
+
+	sub, err := hub.subscribe(topic, group)
+	if err != nil {
+		return err
+	}
+
+	delete(hub.pending, topic)
+	hub.subscriptions[topic] = sub
+	return nil
+}
+
+// subscribe subscribes the topic with the current connection.  Empty group means every instance receives the events.
+// The caller must hold the lock.
+func (hub *Hub) subscribe(topic string, group string) (*natsClient.Subscription, error) {
+	handler := func(msg *natsClient.Msg) {
 		event := cloudevents.NewEvent()
 		err := json.Unmarshal(msg.Data, &event)
 		if err != nil {
@@ -71,10 +297,70 @@ func (hub *Hub) QueueSubscribe(topic string) error {
 			return
 		}
 
-		h := hub.router.Find(topic)
-		c := prelude.NewContext(hub, event)
-		_ = h(c)
-	})
+		c := prelude.NewContext(hub.huber, event)
+		_ = hub.router.Dispatch(msg.Subject, c)
+	}
 
-	return err
+	if group == "" {
+		return hub.conn.Subscribe(topic, handler)
+	}
+	return hub.conn.QueueSubscribe(topic, group, handler)
+}
+
+func (hub *Hub) Unsubscribe(topic string) error {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	delete(hub.pending, topic)
+
+	sub, found := hub.subscriptions[topic]
+	if !found {
+		return nil
+	}
+
+	delete(hub.subscriptions, topic)
+	return sub.Unsubscribe()
+}
+
+func (hub *Hub) Request(ctx context.Context, topic string, event cloudevents.Event) (cloudevents.Event, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, prelude.DefaultRequestTimeout)
+		defer cancel()
+	}
+
+	inbox := natsClient.NewInbox()
+	sub, err := hub.connection().SubscribeSync(inbox)
+	if err != nil {
+		return cloudevents.Event{}, err
+	}
+	defer func() {
+		_ = sub.Unsubscribe()
+	}()
+
+	event = event.Clone()
+	event.SetExtension(prelude.ReplyTo, inbox)
+	err = hub.huber.Publish(topic, event)
+	if err != nil {
+		return cloudevents.Event{}, err
+	}
+
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			return cloudevents.Event{}, err
+		}
+
+		reply := cloudevents.NewEvent()
+		err = json.Unmarshal(msg.Data, &reply)
+		if err != nil {
+			log.Err(err).Warn("hub: json unmarshal failed.")
+			continue
+		}
+
+		correlationID, _ := cast.ToString(reply.Extensions()[prelude.CorrelationID])
+		if correlationID == event.ID() {
+			return reply, prelude.ReplyError(reply)
+		}
+	}
 }
@@ -1,11 +1,15 @@
 package nats
 
 import (
+	"net"
 	"sync"
 	"testing"
+	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
 	"github.com/google/uuid"
+	"github.com/nats-io/nats-server/v2/server"
+	natsClient "github.com/nats-io/nats.go"
 	"github.com/nite-coder/prelude"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -29,7 +33,10 @@ func TestPublishAndQueueSubscribe(t *testing.T) {
 
 	router := prelude.NewRouter("prelude", hub)
 
-	router.AddRoute("sess."+sessionID, func(c *prelude.Context) error {
+	err = router.Presence().Register(prelude.SessionInfo{SessionID: sessionID, NodeID: "node1"})
+	require.NoError(t, err)
+
+	router.AddRoute(prelude.NodeTopic("node1", sessionID), func(c *prelude.Context) error {
 		defer func() {
 			wg.Done()
 		}()
@@ -71,3 +78,107 @@ func TestPublishAndQueueSubscribe(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestNatsOptions(t *testing.T) {
+	hub := Hub{
+		opts: HubOptions{
+			Name:                "gateway1",
+			ReconnectWait:       time.Second,
+			MaxReconnects:       -1,
+			ReconnectBufferSize: -1,
+		},
+	}
+
+	natsOpts, err := hub.natsOptions()
+	require.NoError(t, err)
+
+	opts := natsClient.GetDefaultOptions()
+	for _, opt := range natsOpts {
+		require.NoError(t, opt(&opts))
+	}
+	assert.Equal(t, "gateway1", opts.Name)
+	assert.Equal(t, time.Second, opts.ReconnectWait)
+	assert.Equal(t, -1, opts.MaxReconnect)
+	assert.Equal(t, -1, opts.ReconnectBufSize)
+	assert.NotNil(t, opts.ClosedCB)
+
+	hub.opts.NKeyFile = "not_found.nk"
+	_, err = hub.natsOptions()
+	assert.Error(t, err)
+}
+
+func TestReconnect(t *testing.T) {
+	s := runJetStreamServer(t)
+	port := s.Addr().(*net.TCPAddr).Port
+
+	closed := make(chan struct{}, 1)
+	reconnected := make(chan struct{}, 1)
+	hub, err := NewNatsHub(HubOptions{
+		URL:           s.ClientURL(),
+		ReconnectWait: 50 * time.Millisecond,
+		MaxReconnects: 1,
+		OnDisconnect: func(err error) {
+			select {
+			case closed <- struct{}{}:
+			default:
+			}
+		},
+		OnReconnect: func() {
+			select {
+			case reconnected <- struct{}{}:
+			default:
+			}
+		},
+	})
+	require.NoError(t, err)
+
+	received := make(chan cloudevents.Event, 1)
+	router := prelude.NewRouter("prelude", hub)
+	router.AddRoute("ping", func(c *prelude.Context) error {
+		received <- c.Event
+		return nil
+	})
+
+	// the connection is closed after max reconnects, so the hub connects again and re-establishes the subscriptions
+	s.Shutdown()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't disconnected")
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	restarted, err := server.NewServer(&server.Options{
+		Host:   "127.0.0.1",
+		Port:   port,
+		NoLog:  true,
+		NoSigs: true,
+	})
+	require.NoError(t, err)
+	go restarted.Start()
+	require.True(t, restarted.ReadyForConnections(5*time.Second))
+	t.Cleanup(restarted.Shutdown)
+
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hub didn't reconnect")
+	}
+
+	event := newJetStreamEvent("ping")
+	err = hub.Publish(event.Type(), event)
+	require.NoError(t, err)
+
+	select {
+	case e := <-received:
+		assert.Equal(t, event.ID(), e.ID())
+	case <-time.After(5 * time.Second):
+		t.Fatal("route didn't receive event after reconnecting")
+	}
+
+	natsHub := hub.(*Hub)
+	natsHub.mutex.RLock()
+	assert.Len(t, natsHub.pending, 0)
+	assert.Contains(t, natsHub.subscriptions, "ping")
+	natsHub.mutex.RUnlock()
+}
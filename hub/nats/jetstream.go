@@ -0,0 +1,354 @@
+package nats
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	natsClient "github.com/nats-io/nats.go"
+	"github.com/nite-coder/blackbear/pkg/log"
+	"github.com/nite-coder/prelude"
+)
+
+const (
+	defaultStreamPrefix = "PRELUDE"
+	defaultDurableGroup = "prelude"
+	defaultAckWait      = 30 * time.Second
+	defaultMaxDeliver   = 10
+	defaultMaxAge       = 7 * 24 * time.Hour
+	defaultBackoff      = time.Second
+	defaultMaxBackoff   = time.Minute
+)
+
+// ErrInvalidPrefix is returned when the route prefix of durable topic is a wildcard
+var ErrInvalidPrefix = errors.New("hub: route prefix of jetstream topic can't be a wildcard")
+
+// JetStreamHubOptions is the options of JetStream hub
+type JetStreamHubOptions struct {
+	HubOptions
+	// Prefixes are the route prefixes whose events are stored in streams, e.g. "order" stores "order" and "order.>" events in
+	// PRELUDE_ORDER stream.  Events of other topics, e.g. session and room events, are delivered by core NATS.
+	Prefixes []string
+	// StreamPrefix is the prefix of stream names.  Default is PRELUDE.
+	StreamPrefix string
+	// Replicas is the number of replicas of streams when the streams are created
+	Replicas int
+	// MaxAge is the max age of events in streams.  Streams keep the events after they are acked, because every group has its own
+	// consumers and events published before a group subscribes are delivered to it later, so events are only removed by MaxAge.
+	// Default is 7 days and negative value means unlimited, which lets the streams grow without bound.  It is only applied when the
+	// streams are created.
+	MaxAge time.Duration
+	// AckWait is the time which the server waits for ack before redelivering the event.  Default is 30 seconds.
+	AckWait time.Duration
+	// MaxDeliver is the max number of deliveries of each event.  Default is 10 and negative value means unlimited.
+	MaxDeliver int
+	// Backoff is the delay of the first redelivery when the handler returns error and the delay is doubled for each redelivery.
+	// Default is 1 second.
+	Backoff time.Duration
+	// MaxBackoff is the max delay of redelivery.  Default is 1 minute.
+	MaxBackoff time.Duration
+}
+
+// JetStreamHub delivers the events of durable prefixes with NATS JetStream, so the events which are published while no handler is
+// running are delivered later.  Every group has a durable consumer per topic and the event is acked after the handler returns nil,
+// otherwise it is redelivered with backoff.
+type JetStreamHub struct {
+	*Hub
+	jsMutex         sync.Mutex
+	js              natsClient.JetStreamContext
+	jsOpts          JetStreamHubOptions
+	prefixes        map[string]bool
+	streams         map[string]bool
+	jsSubscriptions map[string]*natsClient.Subscription
+}
+
+// NewJetStreamHub returns a JetStream hub instance
+func NewJetStreamHub(opts JetStreamHubOptions) (prelude.Huber, error) {
+	if opts.StreamPrefix == "" {
+		opts.StreamPrefix = defaultStreamPrefix
+	}
+	if opts.Group == "" {
+		opts.Group = defaultDurableGroup
+	}
+	if opts.AckWait <= 0 {
+		opts.AckWait = defaultAckWait
+	}
+	if opts.MaxDeliver == 0 {
+		opts.MaxDeliver = defaultMaxDeliver
+	}
+	if opts.MaxDeliver < 0 {
+		opts.MaxDeliver = -1
+	}
+	if opts.MaxAge == 0 {
+		opts.MaxAge = defaultMaxAge
+	}
+	if opts.MaxAge < 0 {
+		// zero max age of stream means unlimited
+		opts.MaxAge = 0
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = defaultBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultMaxBackoff
+	}
+
+	prefixes := map[string]bool{}
+	for _, prefix := range opts.Prefixes {
+		if prefix == "*" || prefix == ">" {
+			return nil, ErrInvalidPrefix
+		}
+		prefixes[prefix] = true
+	}
+
+	huber, err := NewNatsHub(opts.HubOptions)
+	if err != nil {
+		return nil, err
+	}
+	core, _ := huber.(*Hub)
+
+	js, err := core.connection().JetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	hub := &JetStreamHub{
+		Hub:             core,
+		js:              js,
+		jsOpts:          opts,
+		prefixes:        prefixes,
+		streams:         map[string]bool{},
+		jsSubscriptions: map[string]*natsClient.Subscription{},
+	}
+	core.huber = hub
+	core.reconnected = hub.resubscribe
+
+	return hub, nil
+}
+
+// prefix returns the route prefix of topic and whether the topic is durable
+func (hub *JetStreamHub) prefix(topic string) (string, bool) {
+	prefix := strings.SplitN(topic, ".", 2)[0]
+	return prefix, hub.prefixes[prefix]
+}
+
+func (hub *JetStreamHub) streamName(prefix string) string {
+	return strings.ToUpper(hub.jsOpts.StreamPrefix + "_" + prefix)
+}
+
+// durableName returns the durable consumer name of the topic for the group, e.g. "order.*.paid" => "payment_order_any_paid"
+func (hub *JetStreamHub) durableName(topic string) string {
+	replacer := strings.NewReplacer(".", "_", "*", "any", ">", "all")
+	return hub.jsOpts.Group + "_" + replacer.Replace(topic)
+}
+
+// ensureStream creates the stream of prefix if it doesn't exist.  The caller must hold the lock.
+func (hub *JetStreamHub) ensureStream(prefix string) (string, error) {
+	name := hub.streamName(prefix)
+	if hub.streams[name] {
+		return name, nil
+	}
+
+	_, err := hub.js.StreamInfo(name)
+	if errors.Is(err, natsClient.ErrStreamNotFound) {
+		_, err = hub.js.AddStream(&natsClient.StreamConfig{
+			Name:     name,
+			Subjects: []string{prefix, prefix + ".>"},
+			Replicas: hub.jsOpts.Replicas,
+			MaxAge:   hub.jsOpts.MaxAge,
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+
+	hub.streams[name] = true
+	return name, nil
+}
+
+func (hub *JetStreamHub) Publish(topic string, event cloudevents.Event) error {
+	prefix, durable := hub.prefix(topic)
+	if !durable {
+		return hub.Hub.Publish(topic, event)
+	}
+
+	err := event.Validate()
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	hub.jsMutex.Lock()
+	_, err = hub.ensureStream(prefix)
+	js := hub.js
+	hub.jsMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// the event id deduplicates the events which are published again by retries
+	_, err = js.Publish(topic, b, natsClient.MsgId(event.ID()))
+	if err != nil {
+		log.Err(err).Str("data", string(b)).Error("hub: publish to jetstream failed")
+		return err
+	}
+
+	return nil
+}
+
+func (hub *JetStreamHub) QueueSubscribe(topic string) error {
+	prefix, durable := hub.prefix(topic)
+	if !durable {
+		return hub.Hub.QueueSubscribe(topic)
+	}
+
+	hub.jsMutex.Lock()
+	defer hub.jsMutex.Unlock()
+
+	if _, found := hub.jsSubscriptions[topic]; found {
+		return nil
+	}
+
+	sub, err := hub.subscribeDurable(prefix, topic)
+	if err != nil {
+		return err
+	}
+
+	hub.jsSubscriptions[topic] = sub
+	return nil
+}
+
+// subscribeDurable creates the durable consumer of the topic if it doesn't exist and binds to it.  The consumer isn't deleted when
+// the subscription is unsubscribed, so other members of the group keep receiving events.  The caller must hold the lock.
+func (hub *JetStreamHub) subscribeDurable(prefix string, topic string) (*natsClient.Subscription, error) {
+	stream, err := hub.ensureStream(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	durable := hub.durableName(topic)
+	_, err = hub.js.ConsumerInfo(stream, durable)
+	if errors.Is(err, natsClient.ErrConsumerNotFound) {
+		_, err = hub.js.AddConsumer(stream, &natsClient.ConsumerConfig{
+			Durable:        durable,
+			DeliverSubject: "_PRELUDE.DELIVER." + stream + "." + durable,
+			DeliverGroup:   hub.jsOpts.Group,
+			DeliverPolicy:  natsClient.DeliverAllPolicy,
+			AckPolicy:      natsClient.AckExplicitPolicy,
+			AckWait:        hub.jsOpts.AckWait,
+			MaxDeliver:     hub.jsOpts.MaxDeliver,
+			FilterSubject:  topic,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return hub.js.QueueSubscribe(topic, hub.jsOpts.Group, hub.handleMsg, natsClient.Bind(stream, durable), natsClient.ManualAck())
+}
+
+// handleMsg acks the event after the handler returns nil, otherwise the event is redelivered with backoff.  The error handler of router
+// is called after the last delivery or at once if the handler returns prelude.Error, which redelivery can't fix, e.g. validation error.
+func (hub *JetStreamHub) handleMsg(msg *natsClient.Msg) {
+	event := cloudevents.NewEvent()
+	err := json.Unmarshal(msg.Data, &event)
+	if err != nil {
+		log.Err(err).Warn("hub: json unmarshal failed.")
+		_ = msg.Term()
+		return
+	}
+
+	c := prelude.NewContext(hub, event)
+	err = hub.router.Handle(msg.Subject, c)
+	if err == nil {
+		_ = msg.Ack()
+		return
+	}
+
+	var typedErr *prelude.Error
+	if errors.As(err, &typedErr) {
+		hub.router.HandleError(c, err)
+		_ = msg.Term()
+		return
+	}
+
+	delivered := uint64(1)
+	if metadata, metaErr := msg.Metadata(); metaErr == nil {
+		delivered = metadata.NumDelivered
+	}
+
+	// the sender is only notified when the event won't be redelivered anymore
+	if hub.jsOpts.MaxDeliver > 0 && delivered >= uint64(hub.jsOpts.MaxDeliver) {
+		hub.router.HandleError(c, err)
+		_ = msg.Term()
+		return
+	}
+
+	delay := hub.backoff(delivered)
+	log.Err(err).Str("action", event.Type()).Str("event_id", event.ID()).Str("delay", delay.String()).Warn("hub: handler failed and event will be redelivered")
+	_ = msg.NakWithDelay(delay)
+}
+
+// backoff returns the delay of redelivery which is doubled for each delivery
+func (hub *JetStreamHub) backoff(delivered uint64) time.Duration {
+	if delivered < 1 {
+		delivered = 1
+	}
+
+	delay := float64(hub.jsOpts.Backoff) * math.Pow(2, float64(delivered-1))
+	if delay > float64(hub.jsOpts.MaxBackoff) {
+		return hub.jsOpts.MaxBackoff
+	}
+	return time.Duration(delay)
+}
+
+// Subscribe subscribes the topic without queue group.  The events of durable prefixes are also delivered by core NATS, so they are
+// delivered at most once to every instance.
+func (hub *JetStreamHub) Subscribe(topic string) error {
+	return hub.Hub.Subscribe(topic)
+}
+
+func (hub *JetStreamHub) Unsubscribe(topic string) error {
+	hub.jsMutex.Lock()
+	defer hub.jsMutex.Unlock()
+
+	sub, found := hub.jsSubscriptions[topic]
+	if !found {
+		return hub.Hub.Unsubscribe(topic)
+	}
+
+	delete(hub.jsSubscriptions, topic)
+	return sub.Unsubscribe()
+}
+
+// resubscribe creates JetStream context with the new connection and binds to the durable consumers again
+func (hub *JetStreamHub) resubscribe(conn *natsClient.Conn) {
+	hub.jsMutex.Lock()
+	defer hub.jsMutex.Unlock()
+
+	js, err := conn.JetStream()
+	if err != nil {
+		log.Err(err).Error("hub: create jetstream context failed")
+		return
+	}
+	hub.js = js
+	hub.streams = map[string]bool{}
+
+	for topic := range hub.jsSubscriptions {
+		prefix, _ := hub.prefix(topic)
+		sub, err := hub.subscribeDurable(prefix, topic)
+		if err != nil {
+			log.Err(err).Str("topic", topic).Error("hub: resubscribe to jetstream failed")
+			continue
+		}
+		hub.jsSubscriptions[topic] = sub
+	}
+}
@@ -0,0 +1,184 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nite-coder/prelude"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runJetStreamServer(t *testing.T) *server.Server {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	require.NoError(t, err)
+
+	go s.Start()
+	require.True(t, s.ReadyForConnections(5*time.Second))
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func newJetStreamEvent(eventType string) cloudevents.Event {
+	event := cloudevents.NewEvent()
+	event.SetID(uuid.NewString())
+	event.SetSource("client")
+	event.SetType(eventType)
+	return event
+}
+
+func TestJetStreamHubDurable(t *testing.T) {
+	s := runJetStreamServer(t)
+
+	opts := JetStreamHubOptions{
+		HubOptions: HubOptions{URL: s.ClientURL(), Group: "payment"},
+		Prefixes:   []string{"order"},
+		Backoff:    10 * time.Millisecond,
+	}
+
+	// the event is stored while no handler is running
+	publisher, err := NewJetStreamHub(opts)
+	require.NoError(t, err)
+	err = publisher.Publish("order.created", newJetStreamEvent("order.created"))
+	require.NoError(t, err)
+
+	hub, err := NewJetStreamHub(opts)
+	require.NoError(t, err)
+	router := prelude.NewRouter("prelude", hub)
+
+	delivered := int32(0)
+	done := make(chan struct{})
+	router.AddRoute("order.created", func(c *prelude.Context) error {
+		// the first delivery fails and the event is redelivered
+		if atomic.AddInt32(&delivered, 1) == 1 {
+			return errors.New("payment service is unavailable")
+		}
+		close(done)
+		return nil
+	})
+
+	select {
+	case <-done:
+		assert.Equal(t, int32(2), atomic.LoadInt32(&delivered))
+	case <-time.After(5 * time.Second):
+		t.Fatal("stored event was not delivered")
+	}
+}
+
+func TestJetStreamHubTypedError(t *testing.T) {
+	s := runJetStreamServer(t)
+
+	hub, err := NewJetStreamHub(JetStreamHubOptions{
+		HubOptions: HubOptions{URL: s.ClientURL(), Group: "room"},
+		Prefixes:   []string{"room"},
+		Backoff:    10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	router := prelude.NewRouter("prelude", hub)
+
+	delivered := int32(0)
+	router.AddRoute("room.join", func(c *prelude.Context) error {
+		atomic.AddInt32(&delivered, 1)
+		return prelude.NewError("room.full", "the room is full")
+	})
+
+	handled := make(chan error, 2)
+	router.ErrorHandler(func(c *prelude.Context, err error) {
+		handled <- err
+	})
+
+	err = hub.Publish("room.join", newJetStreamEvent("room.join"))
+	require.NoError(t, err)
+
+	// the typed error is handled at once and the event isn't redelivered
+	select {
+	case err := <-handled:
+		var typedErr *prelude.Error
+		require.True(t, errors.As(err, &typedErr))
+		assert.Equal(t, "room.full", typedErr.Code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("typed error was not handled")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&delivered))
+}
+
+func TestJetStreamHubCoreTopic(t *testing.T) {
+	s := runJetStreamServer(t)
+
+	hub, err := NewJetStreamHub(JetStreamHubOptions{
+		HubOptions: HubOptions{URL: s.ClientURL()},
+		Prefixes:   []string{"order"},
+	})
+	require.NoError(t, err)
+	router := prelude.NewRouter("prelude", hub)
+
+	router.AddRoute("ping", func(c *prelude.Context) error {
+		return c.Reply("pong")
+	})
+	time.Sleep(100 * time.Millisecond)
+
+	reply, err := hub.Request(context.Background(), "ping", newJetStreamEvent("ping"))
+	require.NoError(t, err)
+	assert.Equal(t, "ping.reply", reply.Type())
+}
+
+func TestJetStreamHubMaxAge(t *testing.T) {
+	s := runJetStreamServer(t)
+
+	tests := map[string]struct {
+		maxAge   time.Duration
+		expected time.Duration
+	}{
+		"default":   {maxAge: 0, expected: defaultMaxAge},
+		"custom":    {maxAge: time.Hour, expected: time.Hour},
+		"unlimited": {maxAge: -1, expected: 0},
+	}
+
+	for prefix, tt := range tests {
+		hub, err := NewJetStreamHub(JetStreamHubOptions{
+			HubOptions: HubOptions{URL: s.ClientURL()},
+			Prefixes:   []string{prefix},
+			MaxAge:     tt.maxAge,
+		})
+		require.NoError(t, err)
+
+		err = hub.Publish(prefix+".created", newJetStreamEvent(prefix+".created"))
+		require.NoError(t, err)
+
+		jsHub := hub.(*JetStreamHub)
+		info, err := jsHub.js.StreamInfo(jsHub.streamName(prefix))
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, info.Config.MaxAge, prefix)
+	}
+}
+
+func TestJetStreamBackoff(t *testing.T) {
+	hub := JetStreamHub{
+		jsOpts: JetStreamHubOptions{
+			HubOptions: HubOptions{Group: "payment"},
+			Backoff:    time.Second,
+			MaxBackoff: 5 * time.Second,
+		},
+	}
+
+	assert.Equal(t, time.Second, hub.backoff(1))
+	assert.Equal(t, 2*time.Second, hub.backoff(2))
+	assert.Equal(t, 4*time.Second, hub.backoff(3))
+	assert.Equal(t, 5*time.Second, hub.backoff(4))
+	assert.Equal(t, "payment_order_any_paid", hub.durableName("order.*.paid"))
+}
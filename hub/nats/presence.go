@@ -0,0 +1,183 @@
+package nats
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	natsClient "github.com/nats-io/nats.go"
+	"github.com/nite-coder/prelude"
+)
+
+const defaultPresenceBucket = "prelude_presence"
+
+// PresenceOptions is the options of KV presence
+type PresenceOptions struct {
+	// Bucket is the name of key-value bucket.  Default is prelude_presence.
+	Bucket string
+	// TTL is the max age of sessions in the bucket.  Gateways must refresh sessions within ttl, see websocket.WithSessionUpdateRoute.
+	TTL time.Duration
+	// Replicas is the number of replicas of bucket when the bucket is created
+	Replicas int
+}
+
+// KVPresence is a prelude.Presence which stores sessions in NATS JetStream key-value bucket, so it is shared by all gateways
+// and services.  Sessions are stored under "sess.<sessionID>" and "user.<userID>.<sessionID>" keys.
+type KVPresence struct {
+	kv natsClient.KeyValue
+}
+
+// NewKVPresence returns a KVPresence instance.  The bucket is created if it doesn't exist.
+func NewKVPresence(conn *natsClient.Conn, opts PresenceOptions) (*KVPresence, error) {
+	if opts.Bucket == "" {
+		opts.Bucket = defaultPresenceBucket
+	}
+
+	js, err := conn.JetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	kv, err := js.KeyValue(opts.Bucket)
+	if errors.Is(err, natsClient.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&natsClient.KeyValueConfig{
+			Bucket:   opts.Bucket,
+			TTL:      opts.TTL,
+			Replicas: opts.Replicas,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &KVPresence{
+		kv: kv,
+	}, nil
+}
+
+// encodeKey encodes the id because only letters, digits and "-_=/." are allowed in keys
+func encodeKey(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+func sessionKey(sessionID string) string {
+	return "sess." + encodeKey(sessionID)
+}
+
+func userKey(userID string, sessionID string) string {
+	return "user." + encodeKey(userID) + "." + encodeKey(sessionID)
+}
+
+// Register adds or refreshes the session
+func (p *KVPresence) Register(info prelude.SessionInfo) error {
+	if info.LastSeenAt.IsZero() {
+		info.LastSeenAt = time.Now().UTC()
+	}
+
+	old, err := p.Lookup(info.SessionID)
+	if err == nil && old.UserID != "" && old.UserID != info.UserID {
+		err = p.kv.Delete(userKey(old.UserID, info.SessionID))
+		if err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.kv.Put(sessionKey(info.SessionID), b)
+	if err != nil {
+		return err
+	}
+
+	if info.UserID != "" {
+		_, err = p.kv.Put(userKey(info.UserID, info.SessionID), b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deregister removes the session
+func (p *KVPresence) Deregister(sessionID string) error {
+	info, err := p.Lookup(sessionID)
+	if errors.Is(err, prelude.ErrSessionNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = p.kv.Delete(sessionKey(sessionID))
+	if err != nil {
+		return err
+	}
+
+	if info.UserID != "" {
+		return p.kv.Delete(userKey(info.UserID, sessionID))
+	}
+	return nil
+}
+
+// Lookup returns the session
+func (p *KVPresence) Lookup(sessionID string) (prelude.SessionInfo, error) {
+	info := prelude.SessionInfo{}
+
+	entry, err := p.kv.Get(sessionKey(sessionID))
+	if errors.Is(err, natsClient.ErrKeyNotFound) {
+		return info, prelude.ErrSessionNotFound
+	}
+	if err != nil {
+		return info, err
+	}
+
+	err = json.Unmarshal(entry.Value(), &info)
+	return info, err
+}
+
+// SessionsOf returns all sessions of the user
+func (p *KVPresence) SessionsOf(userID string) ([]prelude.SessionInfo, error) {
+	watcher, err := p.kv.Watch("user."+encodeKey(userID)+".*", natsClient.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = watcher.Stop()
+	}()
+
+	timer := time.NewTimer(prelude.DefaultRequestTimeout)
+	defer timer.Stop()
+
+	sessions := []prelude.SessionInfo{}
+	for {
+		select {
+		case entry := <-watcher.Updates():
+			// nil entry means all current values were received
+			if entry == nil {
+				return sessions, nil
+			}
+
+			info := prelude.SessionInfo{}
+			err := json.Unmarshal(entry.Value(), &info)
+			if err != nil {
+				return nil, err
+			}
+			sessions = append(sessions, info)
+		case <-timer.C:
+			return nil, natsClient.ErrTimeout
+		}
+	}
+}
+
+// IsOnline returns true if the user has at least one session
+func (p *KVPresence) IsOnline(userID string) (bool, error) {
+	sessions, err := p.SessionsOf(userID)
+	if err != nil {
+		return false, err
+	}
+	return len(sessions) > 0, nil
+}
@@ -0,0 +1,82 @@
+package nats
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	natsClient "github.com/nats-io/nats.go"
+	"github.com/nite-coder/prelude"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVPresence(t *testing.T) {
+	s := runJetStreamServer(t)
+
+	conn, err := natsClient.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	presence, err := NewKVPresence(conn, PresenceOptions{TTL: time.Minute})
+	require.NoError(t, err)
+
+	userID := "user@" + uuid.NewString()
+	sessionID := uuid.NewString()
+
+	err = presence.Register(prelude.SessionInfo{SessionID: sessionID, UserID: userID, NodeID: "node1"})
+	require.NoError(t, err)
+
+	info, err := presence.Lookup(sessionID)
+	require.NoError(t, err)
+	assert.Equal(t, "node1", info.NodeID)
+
+	sessions, err := presence.SessionsOf(userID)
+	require.NoError(t, err)
+	assert.Len(t, sessions, 1)
+
+	online, err := presence.IsOnline(userID)
+	require.NoError(t, err)
+	assert.True(t, online)
+
+	err = presence.Deregister(sessionID)
+	require.NoError(t, err)
+
+	_, err = presence.Lookup(sessionID)
+	assert.ErrorIs(t, err, prelude.ErrSessionNotFound)
+
+	online, err = presence.IsOnline(userID)
+	require.NoError(t, err)
+	assert.False(t, online)
+}
+
+func TestKVPresenceExpiry(t *testing.T) {
+	s := runJetStreamServer(t)
+
+	conn, err := natsClient.Connect(s.ClientURL())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	presence, err := NewKVPresence(conn, PresenceOptions{TTL: time.Second})
+	require.NoError(t, err)
+
+	userID := "user@" + uuid.NewString()
+	sessionID := uuid.NewString()
+
+	err = presence.Register(prelude.SessionInfo{SessionID: sessionID, UserID: userID, NodeID: "node1"})
+	require.NoError(t, err)
+
+	_, err = presence.Lookup(sessionID)
+	require.NoError(t, err)
+
+	// the session which isn't refreshed within ttl is removed
+	assert.Eventually(t, func() bool {
+		_, err := presence.Lookup(sessionID)
+		return errors.Is(err, prelude.ErrSessionNotFound)
+	}, 5*time.Second, 100*time.Millisecond)
+
+	online, err := presence.IsOnline(userID)
+	require.NoError(t, err)
+	assert.False(t, online)
+}
@@ -5,6 +5,7 @@
 package prelude
 
 import (
+	context "context"
 	reflect "reflect"
 
 	v2 "github.com/cloudevents/sdk-go/v2"
@@ -62,6 +63,21 @@ func (mr *MockHuberMockRecorder) QueueSubscribe(topic interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "QueueSubscribe", reflect.TypeOf((*MockHuber)(nil).QueueSubscribe), topic)
 }
 
+// Request mocks base method.
+func (m *MockHuber) Request(ctx context.Context, topic string, event v2.Event) (v2.Event, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Request", ctx, topic, event)
+	ret0, _ := ret[0].(v2.Event)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Request indicates an expected call of Request.
+func (mr *MockHuberMockRecorder) Request(ctx, topic, event interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Request", reflect.TypeOf((*MockHuber)(nil).Request), ctx, topic, event)
+}
+
 // Router mocks base method.
 func (m *MockHuber) Router() *Router {
 	m.ctrl.T.Helper()
@@ -87,3 +103,31 @@ func (mr *MockHuberMockRecorder) SetRouter(router interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetRouter", reflect.TypeOf((*MockHuber)(nil).SetRouter), router)
 }
+
+// Subscribe mocks base method.
+func (m *MockHuber) Subscribe(topic string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Subscribe", topic)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Subscribe indicates an expected call of Subscribe.
+func (mr *MockHuberMockRecorder) Subscribe(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Subscribe", reflect.TypeOf((*MockHuber)(nil).Subscribe), topic)
+}
+
+// Unsubscribe mocks base method.
+func (m *MockHuber) Unsubscribe(topic string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Unsubscribe", topic)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Unsubscribe indicates an expected call of Unsubscribe.
+func (mr *MockHuberMockRecorder) Unsubscribe(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unsubscribe", reflect.TypeOf((*MockHuber)(nil).Unsubscribe), topic)
+}
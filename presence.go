@@ -0,0 +1,172 @@
+package prelude
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrSessionNotFound is returned by Presence when the session isn't registered or it is expired
+var ErrSessionNotFound = errors.New("prelude: session not found")
+
+// SessionInfo is the presence record of session
+type SessionInfo struct {
+	SessionID  string    `json:"session_id"`
+	UserID     string    `json:"user_id,omitempty"`
+	NodeID     string    `json:"node_id"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+// Presence records which gateway node every session is connected to and which sessions every user has, so events can be
+// published to the node topic of session or to all sessions of user.  Gateways and services must share the same presence.
+type Presence interface {
+	// Register adds or refreshes the session.  The session expires if it isn't refreshed in time.
+	Register(info SessionInfo) error
+	Deregister(sessionID string) error
+	// Lookup returns the session.  It returns ErrSessionNotFound if the session isn't registered.
+	Lookup(sessionID string) (SessionInfo, error)
+	// SessionsOf returns all sessions of the user
+	SessionsOf(userID string) ([]SessionInfo, error)
+	// IsOnline returns true if the user has at least one session
+	IsOnline(userID string) (bool, error)
+}
+
+type presenceEntry struct {
+	info      SessionInfo
+	updatedAt time.Time
+}
+
+// MemoryPresence is a Presence which keeps sessions in memory.  It is only useful when gateways and services run in the same process.
+type MemoryPresence struct {
+	mutex    sync.RWMutex
+	ttl      time.Duration
+	sessions map[string]presenceEntry
+	users    map[string]map[string]bool
+}
+
+// NewMemoryPresence returns a MemoryPresence instance.  Sessions which are not refreshed within ttl are expired and zero ttl means
+// sessions never expire.
+func NewMemoryPresence(ttl time.Duration) *MemoryPresence {
+	return &MemoryPresence{
+		ttl:      ttl,
+		sessions: map[string]presenceEntry{},
+		users:    map[string]map[string]bool{},
+	}
+}
+
+// Register adds or refreshes the session
+func (p *MemoryPresence) Register(info SessionInfo) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if info.LastSeenAt.IsZero() {
+		info.LastSeenAt = time.Now().UTC()
+	}
+
+	if old, found := p.sessions[info.SessionID]; found && old.info.UserID != info.UserID {
+		p.deleteUserSession(old.info.UserID, info.SessionID)
+	}
+
+	p.sessions[info.SessionID] = presenceEntry{
+		info:      info,
+		updatedAt: time.Now(),
+	}
+
+	if info.UserID != "" {
+		sessionIDs, found := p.users[info.UserID]
+		if !found {
+			sessionIDs = map[string]bool{}
+			p.users[info.UserID] = sessionIDs
+		}
+		sessionIDs[info.SessionID] = true
+	}
+	return nil
+}
+
+// Deregister removes the session
+func (p *MemoryPresence) Deregister(sessionID string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.deleteSession(sessionID)
+	return nil
+}
+
+func (p *MemoryPresence) deleteSession(sessionID string) {
+	entry, found := p.sessions[sessionID]
+	if !found {
+		return
+	}
+
+	delete(p.sessions, sessionID)
+	p.deleteUserSession(entry.info.UserID, sessionID)
+}
+
+func (p *MemoryPresence) deleteUserSession(userID string, sessionID string) {
+	sessionIDs, found := p.users[userID]
+	if !found {
+		return
+	}
+
+	delete(sessionIDs, sessionID)
+	if len(sessionIDs) == 0 {
+		delete(p.users, userID)
+	}
+}
+
+func (p *MemoryPresence) expired(entry presenceEntry) bool {
+	return p.ttl > 0 && time.Since(entry.updatedAt) > p.ttl
+}
+
+// Lookup returns the session
+func (p *MemoryPresence) Lookup(sessionID string) (SessionInfo, error) {
+	p.mutex.RLock()
+	entry, found := p.sessions[sessionID]
+	p.mutex.RUnlock()
+
+	if !found {
+		return SessionInfo{}, ErrSessionNotFound
+	}
+
+	if p.expired(entry) {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		// the session might be refreshed by Register before the write lock is taken
+		entry, found = p.sessions[sessionID]
+		if !found {
+			return SessionInfo{}, ErrSessionNotFound
+		}
+		if p.expired(entry) {
+			p.deleteSession(sessionID)
+			return SessionInfo{}, ErrSessionNotFound
+		}
+	}
+
+	return entry.info, nil
+}
+
+// SessionsOf returns all sessions of the user
+func (p *MemoryPresence) SessionsOf(userID string) ([]SessionInfo, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	sessions := []SessionInfo{}
+	for sessionID := range p.users[userID] {
+		entry := p.sessions[sessionID]
+		if p.expired(entry) {
+			p.deleteSession(sessionID)
+			continue
+		}
+		sessions = append(sessions, entry.info)
+	}
+	return sessions, nil
+}
+
+// IsOnline returns true if the user has at least one session
+func (p *MemoryPresence) IsOnline(userID string) (bool, error) {
+	sessions, err := p.SessionsOf(userID)
+	if err != nil {
+		return false, err
+	}
+	return len(sessions) > 0, nil
+}
@@ -0,0 +1,59 @@
+package prelude
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryPresence(t *testing.T) {
+	presence := NewMemoryPresence(0)
+
+	err := presence.Register(SessionInfo{SessionID: "sess1", UserID: "user1", NodeID: "node1"})
+	require.NoError(t, err)
+	err = presence.Register(SessionInfo{SessionID: "sess2", UserID: "user1", NodeID: "node2"})
+	require.NoError(t, err)
+
+	info, err := presence.Lookup("sess2")
+	require.NoError(t, err)
+	assert.Equal(t, "node2", info.NodeID)
+	assert.False(t, info.LastSeenAt.IsZero())
+
+	sessions, err := presence.SessionsOf("user1")
+	require.NoError(t, err)
+	assert.Len(t, sessions, 2)
+
+	err = presence.Deregister("sess1")
+	require.NoError(t, err)
+	err = presence.Deregister("sess2")
+	require.NoError(t, err)
+
+	online, err := presence.IsOnline("user1")
+	require.NoError(t, err)
+	assert.False(t, online)
+
+	_, err = presence.Lookup("sess1")
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+}
+
+func TestMemoryPresenceExpiry(t *testing.T) {
+	presence := NewMemoryPresence(50 * time.Millisecond)
+
+	err := presence.Register(SessionInfo{SessionID: "sess1", UserID: "user1", NodeID: "node1"})
+	require.NoError(t, err)
+
+	online, err := presence.IsOnline("user1")
+	require.NoError(t, err)
+	assert.True(t, online)
+
+	time.Sleep(100 * time.Millisecond)
+
+	online, err = presence.IsOnline("user1")
+	require.NoError(t, err)
+	assert.False(t, online)
+
+	_, err = presence.Lookup("sess1")
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+}
@@ -1,28 +1,87 @@
 package prelude
 
-import "strings"
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nite-coder/blackbear/pkg/log"
+)
 
 // HandlerFunc defines a function to server HTTP requests
 type HandlerFunc func(c *Context) error
 
 type Router struct {
-	name string
-	tree *tree
-	hub  Huber
+	panics       uint64 // must be the first field for 64-bit atomic operations on 32-bit platforms
+	mutex        sync.RWMutex
+	name         string
+	tree         *tree
+	hub          Huber
+	middlewares  []HandlerFunc
+	presence     Presence
+	errorHandler ErrorHandlerFunc
+	notFound     HandlerFunc
 }
 
-type tree struct {
-	rootNode *node
+// RouteNotFoundEventType is the type of event which is sent to the sender by the default not-found handler
+const RouteNotFoundEventType = "route.not_found"
+
+// RouteNotFound is the data of route.not_found event
+type RouteNotFound struct {
+	Type string `json:"type"`
 }
 
-type kind uint8
+// RouteOption configures a single route which is added by AddRoute
+type RouteOption func(*route)
 
-var (
-	notFoundHandler = func(c *Context) {
+type route struct {
+	middlewares []HandlerFunc
+	delivery    Delivery
+	// skipGlobal means the global middlewares which are added by Use aren't executed
+	skipGlobal bool
+}
 
-	}
+// Delivery decides how the events of route are delivered to the instances which add the route
+type Delivery int
+
+const (
+	// QueueDelivery delivers each event to one instance of the queue group.  It is the default.
+	QueueDelivery Delivery = iota
+	// BroadcastDelivery delivers each event to every instance, e.g. cache invalidation
+	BroadcastDelivery
 )
 
+// WithDelivery sets the delivery of route
+func WithDelivery(delivery Delivery) RouteOption {
+	return func(r *route) {
+		r.delivery = delivery
+	}
+}
+
+// WithMiddleware appends route level middlewares which are executed after the global middlewares
+func WithMiddleware(middlewares ...HandlerFunc) RouteOption {
+	return func(r *route) {
+		r.middlewares = append(r.middlewares, middlewares...)
+	}
+}
+
+// WithoutGlobalMiddleware skips the global middlewares of router for the route.  It is used by the internal routes of gateways, e.g.
+// broadcast and node topics, whose events are sent by services and don't carry the extensions of clients which the application
+// middlewares check, e.g. userid of authentication middleware.
+func WithoutGlobalMiddleware() RouteOption {
+	return func(r *route) {
+		r.skipGlobal = true
+	}
+}
+
+type tree struct {
+	rootNode *node
+}
+
+type kind uint8
+
 const (
 	skind kind = iota
 	pkind
@@ -40,7 +99,10 @@ func NewRouter(name string, hub Huber) *Router {
 
 func newRouter() *Router {
 	r := Router{
-		name: "default",
+		name:         "default",
+		presence:     NewMemoryPresence(0),
+		errorHandler: DefaultErrorHandler,
+		notFound:     DefaultNotFoundHandler,
 		tree: &tree{
 			rootNode: &node{
 				parent:    nil,
@@ -54,15 +116,59 @@ func newRouter() *Router {
 	return &r
 }
 
+// Presence returns the presence which records sessions of gateway nodes and users
+func (r *Router) Presence() Presence {
+	return r.presence
+}
+
+// SetPresence replaces the default in-memory presence.  Gateways and services must share the same presence, e.g. NATS KV presence,
+// otherwise services in other processes than the gateways can't find the sessions and writing to them returns ErrSessionNotFound.
+func (r *Router) SetPresence(presence Presence) {
+	r.presence = presence
+}
+
+// ErrorHandler replaces the default error handler which handles the errors returned by handlers
+func (r *Router) ErrorHandler(handler ErrorHandlerFunc) {
+	r.errorHandler = handler
+}
+
+// NotFound replaces the default handler which handles the events whose action doesn't match any route
+func (r *Router) NotFound(handler HandlerFunc) {
+	r.notFound = handler
+}
+
+// DefaultNotFoundHandler sends route.not_found event which is correlated to the unknown event back to the sender, so client developers
+// see typos in event types immediately.
+func DefaultNotFoundHandler(c *Context) error {
+	log.Str("action", c.Event.Type()).Str("event_id", c.Event.ID()).Warn("prelude: route not found")
+	if !c.hasSender() {
+		return nil
+	}
+	return c.reply(RouteNotFoundEventType, RouteNotFound{Type: c.Event.Type()})
+}
+
+// Use appends global middlewares to the router.  Middlewares are only applied to routes which are added after Use is called.
+func (r *Router) Use(middlewares ...HandlerFunc) {
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
 // AddRoute function which adding action and handler to router
-func (r *Router) AddRoute(action string, handler HandlerFunc) {
+func (r *Router) AddRoute(action string, handler HandlerFunc, opts ...RouteOption) {
 	if len(action) == 0 {
 		panic("router: action couldn't be empty")
 	}
 
+	rt := route{}
+	for _, opt := range opts {
+		opt(&rt)
+	}
+	handler = r.chain(rt, handler)
+
+	r.mutex.Lock()
 	currentNode := r.tree.rootNode
 	if action == "" {
 		currentNode.handler = handler
+		r.mutex.Unlock()
 		return
 	}
 
@@ -76,12 +182,33 @@ func (r *Router) AddRoute(action string, handler HandlerFunc) {
 		}
 
 		var childNode *node
-		// this is static node
-		childNode = currentNode.findChildByName(element)
-		if childNode == nil {
-			childNode = newNode(element, skind)
-			currentNode.addChild(childNode)
-
+		switch {
+		case element[0] == ':':
+			// this is param node
+			childNode = currentNode.findChildByKind(pkind)
+			if childNode == nil {
+				childNode = newNode(":", pkind)
+				currentNode.addChild(childNode)
+			}
+			pathParams = append(pathParams, element[1:])
+		case element == "*" || element == ">":
+			// this is catch-all node
+			if count != index+1 {
+				panic("router: catch-all segment must be the last segment of action")
+			}
+			childNode = currentNode.findChildByKind(akind)
+			if childNode == nil {
+				childNode = newNode("*", akind)
+				currentNode.addChild(childNode)
+			}
+			pathParams = append(pathParams, "*")
+		default:
+			// this is static node
+			childNode = currentNode.findChildByName(element)
+			if childNode == nil {
+				childNode = newNode(element, skind)
+				currentNode.addChild(childNode)
+			}
 		}
 
 		// last node in the path
@@ -92,43 +219,173 @@ func (r *Router) AddRoute(action string, handler HandlerFunc) {
 
 		currentNode = childNode
 	}
+	r.mutex.Unlock()
 
 	if r.hub == nil {
 		return
 	}
 
-	_ = r.hub.QueueSubscribe(action)
+	if rt.delivery == BroadcastDelivery {
+		_ = r.hub.Subscribe(toTopic(action))
+		return
+	}
+	_ = r.hub.QueueSubscribe(toTopic(action))
 }
 
-// Find returns http handler for specific path
-func (r *Router) Find(path string) HandlerFunc {
+// RemoveRoute removes the handler of action from router and unsubscribes the topic of action from hub.  Nodes which don't have
+// handler and children are removed from the tree.
+func (r *Router) RemoveRoute(action string) {
+	r.mutex.Lock()
 	currentNode := r.tree.rootNode
-	if path == "" {
+	for _, element := range strings.Split(action, ".") {
+		if len(element) == 0 {
+			continue
+		}
+
+		switch {
+		case element[0] == ':':
+			currentNode = currentNode.findChildByKind(pkind)
+		case element == "*" || element == ">":
+			currentNode = currentNode.findChildByKind(akind)
+		default:
+			currentNode = currentNode.findChildByName(element)
+		}
+
+		if currentNode == nil {
+			r.mutex.Unlock()
+			return
+		}
+	}
+
+	currentNode.handler = nil
+	currentNode.params = nil
+	for currentNode.parent != nil && currentNode.handler == nil && len(currentNode.children) == 0 {
+		parent := currentNode.parent
+		parent.removeChild(currentNode)
+		currentNode = parent
+	}
+	r.mutex.Unlock()
+
+	if r.hub == nil {
+		return
+	}
+
+	_ = r.hub.Unsubscribe(toTopic(action))
+}
+
+// chain combines global middlewares, route middlewares and handler into a single handler
+func (r *Router) chain(rt route, handler HandlerFunc) HandlerFunc {
+	handlers := make([]HandlerFunc, 0, len(r.middlewares)+len(rt.middlewares)+1)
+	if !rt.skipGlobal {
+		handlers = append(handlers, r.middlewares...)
+	}
+	handlers = append(handlers, rt.middlewares...)
+	handlers = append(handlers, handler)
+
+	return func(c *Context) error {
+		c.handlers = handlers
+		c.index = -1
+		return c.Next()
+	}
+}
+
+// Find returns handler for specific action or nil if no route matches.  Static segments have higher priority than param segments and param segments have higher
+// priority than catch-all segments.
+func (r *Router) Find(action string) HandlerFunc {
+	return r.find(action, nil)
+}
+
+// find returns handler for specific action like Find and stores the values of param segments in the context if it is not nil
+func (r *Router) find(action string, c *Context) HandlerFunc {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	currentNode := r.tree.rootNode
+	if action == "" {
 		return currentNode.handler
 	}
 
-	pathArray := strings.Split(path, ".")
-	count := len(pathArray)
+	matchedNode, values := currentNode.match(strings.Split(action, "."), []string{})
+	if matchedNode == nil {
+		return nil
+	}
 
-	for index, element := range pathArray {
-		// find static node first
-		childNode := currentNode.findChildByName(element)
+	if c != nil {
+		c.pnames = matchedNode.params
+		c.pvalues = values
+	}
+	return matchedNode.handler
+}
 
-		if childNode == nil {
-			// return notFoundHandler
-			return nil
-		}
+// Dispatch executes the handler of topic with the context.  The error of handler is passed to the error handler of router and returned.
+// Hubs call it for every received event.
+func (r *Router) Dispatch(topic string, c *Context) error {
+	err := r.Handle(topic, c)
+	if err != nil {
+		r.HandleError(c, err)
+	}
+	return err
+}
 
-		// last node in the path
-		if count == index+1 {
-			return childNode.handler
+// Handle executes the handler of topic with the context and returns the error of handler without passing it to the error handler.
+// The panic of handler is recovered and returned as ErrHandlerPanic, so one bad handler can't crash the process.
+func (r *Router) Handle(topic string, c *Context) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = r.recovered(c, rec, "prelude: handler panicked")
 		}
+	}()
 
-		currentNode = childNode
+	h := r.find(topic, c)
+	if h == nil {
+		h = r.notFound
+	}
+	if h == nil {
+		return nil
 	}
+	return h(c)
+}
 
-	// return notFoundHandler
-	return nil
+// recovered counts and logs the recovered panic with stack trace and returns it as ErrHandlerPanic
+func (r *Router) recovered(c *Context, rec interface{}, msg string) error {
+	atomic.AddUint64(&r.panics, 1)
+	log.Str("action", c.Event.Type()).Str("event_id", c.Event.ID()).Str("panic", fmt.Sprint(rec)).
+		Str("stack", string(debug.Stack())).Error(msg)
+	return fmt.Errorf("%w: %v", ErrHandlerPanic, rec)
+}
+
+// PanicCount returns the number of handler and error handler panics which were recovered
+func (r *Router) PanicCount() uint64 {
+	return atomic.LoadUint64(&r.panics)
+}
+
+// HandleError passes the error to the error handler of router.  The panic of error handler is recovered and logged as well.
+func (r *Router) HandleError(c *Context, err error) {
+	if r.errorHandler == nil {
+		return
+	}
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			_ = r.recovered(c, rec, "prelude: error handler panicked")
+		}
+	}()
+	r.errorHandler(c, err)
+}
+
+// toTopic converts the action to hub topic.  Param segments become "*" and catch-all segment becomes ">",
+// e.g. "room.:roomID.join" => "room.*.join"
+func toTopic(action string) string {
+	elements := strings.Split(action, ".")
+	for index, element := range elements {
+		switch {
+		case len(element) > 0 && element[0] == ':':
+			elements[index] = "*"
+		case element == "*" && index == len(elements)-1:
+			elements[index] = ">"
+		}
+	}
+	return strings.Join(elements, ".")
 }
 
 type node struct {
@@ -155,6 +412,16 @@ func (n *node) addChild(node *node) {
 	n.children = append(n.children, node)
 }
 
+func (n *node) removeChild(node *node) {
+	for idx, element := range n.children {
+		if element == node {
+			n.children = append(n.children[:idx], n.children[idx+1:]...)
+			node.parent = nil
+			return
+		}
+	}
+}
+
 func (n *node) findChildByName(name string) *node {
 	var result *node
 	for _, element := range n.children {
@@ -166,6 +433,39 @@ func (n *node) findChildByName(name string) *node {
 	return result
 }
 
+// match finds the node which handles the remaining elements with backtracking and collects values of param segments
+func (n *node) match(elements []string, values []string) (*node, []string) {
+	if len(elements) == 0 {
+		if n.handler == nil {
+			return nil, values
+		}
+		return n, values
+	}
+
+	element := elements[0]
+
+	// find static node first
+	if childNode := n.findChildByName(element); childNode != nil {
+		if matchedNode, matchedValues := childNode.match(elements[1:], values); matchedNode != nil {
+			return matchedNode, matchedValues
+		}
+	}
+
+	// find param node
+	if childNode := n.findChildByKind(pkind); childNode != nil && len(element) > 0 {
+		if matchedNode, matchedValues := childNode.match(elements[1:], append(values, element)); matchedNode != nil {
+			return matchedNode, matchedValues
+		}
+	}
+
+	// catch-all node matches one or more remaining elements
+	if childNode := n.findChildByKind(akind); childNode != nil && childNode.handler != nil {
+		return childNode, append(values, strings.Join(elements, "."))
+	}
+
+	return nil, values
+}
+
 func (n *node) findChildByKind(t kind) *node {
 	for _, c := range n.children {
 		if c.kind == t {
@@ -33,3 +33,209 @@ func TestRouterStaticRoute(t *testing.T) {
 	testRoute(t, "hello.put")
 	testRoute(t, "hello.Delet")
 }
+
+func TestRouterMiddleware(t *testing.T) {
+	router := newRouter()
+
+	steps := []string{}
+	router.Use(func(c *Context) error {
+		steps = append(steps, "global_before")
+		err := c.Next()
+		steps = append(steps, "global_after")
+		return err
+	})
+
+	router.AddRoute("hello", func(c *Context) error {
+		steps = append(steps, "handler")
+		return nil
+	}, WithMiddleware(func(c *Context) error {
+		steps = append(steps, "route")
+		return nil
+	}))
+
+	event := cloudevents.NewEvent()
+	c := NewContext(nil, event)
+	h := router.Find("hello")
+	err := h(c)
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"global_before", "route", "handler", "global_after"}, steps)
+}
+
+func TestRouterMiddlewareAbort(t *testing.T) {
+	router := newRouter()
+
+	passed := false
+	router.Use(func(c *Context) error {
+		c.Abort()
+		return nil
+	})
+
+	router.AddRoute("hello", func(c *Context) error {
+		passed = true
+		return nil
+	})
+
+	event := cloudevents.NewEvent()
+	c := NewContext(nil, event)
+	h := router.Find("hello")
+	err := h(c)
+
+	require.NoError(t, err)
+	assert.True(t, c.IsAborted())
+	assert.False(t, passed)
+}
+
+func TestRouterParamRoute(t *testing.T) {
+	router := newRouter()
+
+	router.AddRoute("room.:roomID.join", func(c *Context) error {
+		assert.Equal(t, "abc", c.Param("roomID"))
+		return nil
+	})
+
+	router.AddRoute("room.lobby.join", func(c *Context) error {
+		assert.Equal(t, "", c.Param("roomID"))
+		return nil
+	})
+
+	router.AddRoute("game.:gameID.*", func(c *Context) error {
+		assert.Equal(t, "g1", c.Param("gameID"))
+		assert.Equal(t, "player.move", c.Param("*"))
+		return nil
+	})
+
+	for _, action := range []string{"room.abc.join", "room.lobby.join", "game.g1.player.move"} {
+		c := NewContext(nil, cloudevents.NewEvent())
+		h := router.find(action, c)
+		require.NotNil(t, h, action)
+		require.NoError(t, h(c))
+	}
+
+	assert.Nil(t, router.Find("room.abc.leave"))
+	assert.Nil(t, router.Find("game.g1"))
+}
+
+func TestRouterParamRouteBacktracking(t *testing.T) {
+	router := newRouter()
+
+	router.AddRoute("room.lobby", func(c *Context) error {
+		return nil
+	})
+
+	router.AddRoute("room.:roomID.join", func(c *Context) error {
+		assert.Equal(t, "lobby", c.Param("roomID"))
+		return nil
+	})
+
+	c := NewContext(nil, cloudevents.NewEvent())
+	h := router.find("room.lobby.join", c)
+	require.NotNil(t, h)
+	require.NoError(t, h(c))
+}
+
+func TestRouterRemoveRoute(t *testing.T) {
+	router := newRouter()
+	handler := func(c *Context) error {
+		return nil
+	}
+
+	router.AddRoute("sess.abc", handler)
+	router.AddRoute("sess.abc.reply", handler)
+	router.AddRoute("room.:roomID.join", handler)
+
+	router.RemoveRoute("sess.abc")
+	assert.Nil(t, router.Find("sess.abc"))
+	assert.NotNil(t, router.Find("sess.abc.reply"))
+
+	router.RemoveRoute("sess.abc.reply")
+	assert.Nil(t, router.Find("sess.abc.reply"))
+
+	router.RemoveRoute("room.:roomID.join")
+	assert.Nil(t, router.Find("room.lobby.join"))
+
+	// all nodes are removed from the tree
+	assert.Len(t, router.tree.rootNode.children, 0)
+
+	// unknown route is ignored
+	router.RemoveRoute("unknown.route")
+}
+
+func TestRouterErrorHandler(t *testing.T) {
+	router := newRouter()
+
+	handlerErr := NewError("room.full", "the room is full")
+	router.AddRoute("room.join", func(c *Context) error {
+		return handlerErr
+	})
+	router.AddRoute("room.leave", func(c *Context) error {
+		return nil
+	})
+
+	var handledErr error
+	router.ErrorHandler(func(c *Context, err error) {
+		handledErr = err
+	})
+
+	err := router.Dispatch("room.join", NewContext(nil, cloudevents.NewEvent()))
+	assert.Equal(t, handlerErr, err)
+	assert.Equal(t, handlerErr, handledErr)
+
+	handledErr = nil
+	err = router.Dispatch("room.leave", NewContext(nil, cloudevents.NewEvent()))
+	require.NoError(t, err)
+	assert.Nil(t, handledErr)
+}
+
+func TestRouterPanicRecovery(t *testing.T) {
+	router := newRouter()
+
+	router.AddRoute("boom", func(c *Context) error {
+		panic("something went wrong")
+	})
+
+	var handledErr error
+	router.ErrorHandler(func(c *Context, err error) {
+		handledErr = err
+	})
+
+	err := router.Dispatch("boom", NewContext(nil, cloudevents.NewEvent()))
+	assert.ErrorIs(t, err, ErrHandlerPanic)
+	assert.ErrorIs(t, handledErr, ErrHandlerPanic)
+	assert.Equal(t, uint64(1), router.PanicCount())
+
+	// the panic of error handler is recovered as well
+	router.ErrorHandler(func(c *Context, err error) {
+		panic("error handler is broken")
+	})
+	err = router.Dispatch("boom", NewContext(nil, cloudevents.NewEvent()))
+	assert.ErrorIs(t, err, ErrHandlerPanic)
+	assert.Equal(t, uint64(3), router.PanicCount())
+}
+
+func TestRouterNotFound(t *testing.T) {
+	router := newRouter()
+
+	// no sender, so the default handler only logs
+	err := router.Dispatch("unknown", NewContext(nil, cloudevents.NewEvent()))
+	require.NoError(t, err)
+
+	var action string
+	router.NotFound(func(c *Context) error {
+		action = c.Event.Type()
+		return nil
+	})
+
+	event := cloudevents.NewEvent()
+	event.SetType("chat.sned")
+	err = router.Dispatch("chat.sned", NewContext(nil, event))
+	require.NoError(t, err)
+	assert.Equal(t, "chat.sned", action)
+}
+
+func TestToTopic(t *testing.T) {
+	assert.Equal(t, "hello", toTopic("hello"))
+	assert.Equal(t, "room.*.join", toTopic("room.:roomID.join"))
+	assert.Equal(t, "game.*.>", toTopic("game.:gameID.*"))
+	assert.Equal(t, "game.>", toTopic("game.>"))
+}